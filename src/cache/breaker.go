@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrCircuitOpen = errors.New("redis circuit breaker is open")
+
+// guards RedisClient, nil until Init
+var Breaker *CircuitBreaker
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// stops sending commands to redis after threshold consecutive failures, so requests fall back
+// to the local cache and the database right away instead of waiting for timeouts.
+// after cooldown a single command is let through to probe whether redis is back
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     int
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// configured by REDIS_BREAKER_THRESHOLD (default 5 failures) and REDIS_BREAKER_COOLDOWN (default 10 seconds)
+func newBreakerFromEnv() *CircuitBreaker {
+	threshold := 5
+	if n, err := strconv.Atoi(os.Getenv("REDIS_BREAKER_THRESHOLD")); err == nil && n > 0 {
+		threshold = n
+	}
+	cooldown := 10 * time.Second
+	if seconds, err := strconv.Atoi(os.Getenv("REDIS_BREAKER_COOLDOWN")); err == nil && seconds > 0 {
+		cooldown = time.Duration(seconds) * time.Second
+	}
+	return NewCircuitBreaker(threshold, cooldown)
+}
+
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !isConnectionError(err) {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			metrics.breakerOpens.Add(1)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// whether commands are currently being rejected, and since when
+func (b *CircuitBreaker) Open() (bool, time.Time) {
+	if b == nil {
+		return false, time.Time{}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state != breakerClosed, b.openedAt
+}
+
+// replies such as a missing key or a script error mean redis is up
+func isConnectionError(err error) bool {
+	if err == nil || errors.Is(err, redis.Nil) {
+		return false
+	}
+	var replyErr redis.Error
+	return !errors.As(err, &replyErr)
+}
+
+func (b *CircuitBreaker) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (b *CircuitBreaker) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !b.allow() {
+			cmd.SetErr(ErrCircuitOpen)
+			return ErrCircuitOpen
+		}
+
+		err := next(ctx, cmd)
+		b.record(err)
+		return err
+	}
+}
+
+func (b *CircuitBreaker) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if !b.allow() {
+			for _, cmd := range cmds {
+				cmd.SetErr(ErrCircuitOpen)
+			}
+			return ErrCircuitOpen
+		}
+
+		err := next(ctx, cmds)
+		b.record(err)
+		return err
+	}
+}
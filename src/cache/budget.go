@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// impression budgets of a banner, 0 means unlimited
+type Budget struct {
+	BannerID uint
+	Daily    int64
+	Lifetime int64
+	StartAt  time.Time
+	EndAt    time.Time
+}
+
+func (b Budget) IsLimited() bool {
+	return b.Daily > 0 || b.Lifetime > 0
+}
+
+// how many impressions may have been spent by now for the budget to be spread evenly over the
+// banner's window, -1 means unlimited. one extra impression is allowed so delivery can start right away
+func (b Budget) Allowed(now time.Time) (daily, lifetime int64) {
+	daily, lifetime = -1, -1
+
+	if b.Lifetime > 0 {
+		lifetime = paced(b.Lifetime, b.StartAt, b.EndAt, now)
+	}
+
+	if b.Daily > 0 {
+		dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		dayEnd := dayStart.Add(24 * time.Hour)
+		if b.StartAt.After(dayStart) {
+			dayStart = b.StartAt
+		}
+		if b.EndAt.Before(dayEnd) {
+			dayEnd = b.EndAt
+		}
+		daily = paced(b.Daily, dayStart, dayEnd, now)
+	}
+
+	return daily, lifetime
+}
+
+func paced(total int64, start, end, now time.Time) int64 {
+	window := end.Sub(start)
+	if window <= 0 || !now.Before(end) {
+		return total
+	}
+
+	allowed := int64(float64(total)*float64(now.Sub(start))/float64(window)) + 1
+	if allowed > total {
+		return total
+	}
+	return allowed
+}
+
+// key: budget:{banner id}:d:day | budget:{banner id}:l, value: impressions spent.
+// the banner id is the hash tag so the script below can touch both keys in a cluster
+func budgetKeys(bannerID uint, now time.Time) (daily, lifetime string) {
+	prefix := fmt.Sprintf("budget:{%d}", bannerID)
+	return prefix + ":d:" + now.Format("20060102"), prefix + ":l"
+}
+
+// spends one impression if neither counter reached its allowance, so concurrent serves cannot overspend
+var spendBudgetScript = redis.NewScript(`
+local daily = tonumber(redis.call('GET', KEYS[1]) or '0')
+local lifetime = tonumber(redis.call('GET', KEYS[2]) or '0')
+local dailyAllowed = tonumber(ARGV[1])
+local lifetimeAllowed = tonumber(ARGV[2])
+
+if (dailyAllowed >= 0 and daily >= dailyAllowed) or (lifetimeAllowed >= 0 and lifetime >= lifetimeAllowed) then
+	return 0
+end
+
+redis.call('INCR', KEYS[1])
+redis.call('EXPIRE', KEYS[1], 172800)
+redis.call('INCR', KEYS[2])
+redis.call('EXPIREAT', KEYS[2], ARGV[3])
+return 1
+`)
+
+// returns the ids of the banners that are ahead of their pace and should not be served now
+func ThrottledBanners(ctx context.Context, budgets []Budget) (map[uint]bool, error) {
+	throttled := map[uint]bool{}
+	now := time.Now()
+
+	keys := []string{}
+	for _, b := range budgets {
+		daily, lifetime := budgetKeys(b.BannerID, now)
+		keys = append(keys, daily, lifetime)
+	}
+
+	if len(keys) == 0 {
+		return throttled, nil
+	}
+
+	// the keys of different banners can live on different cluster slots, so no MGET
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, k := range keys {
+			cmds[i] = pipe.Get(ctx, k)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	counts := make([]interface{}, len(cmds))
+	for i, cmd := range cmds {
+		if cmd.Err() == nil {
+			counts[i] = cmd.Val()
+		}
+	}
+
+	for i, b := range budgets {
+		dailyAllowed, lifetimeAllowed := b.Allowed(now)
+		if parseCount(counts[2*i]) >= dailyAllowed && dailyAllowed >= 0 ||
+			parseCount(counts[2*i+1]) >= lifetimeAllowed && lifetimeAllowed >= 0 {
+			throttled[b.BannerID] = true
+		}
+	}
+
+	return throttled, nil
+}
+
+func parseCount(count interface{}) int64 {
+	s, ok := count.(string)
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// atomically spends one impression of the budget, false means the banner ran out in the meantime
+func SpendBudget(ctx context.Context, b Budget) (bool, error) {
+	now := time.Now()
+	daily, lifetime := budgetKeys(b.BannerID, now)
+	dailyAllowed, lifetimeAllowed := b.Allowed(now)
+
+	ok, err := spendBudgetScript.Run(ctx, RedisClient, []string{daily, lifetime},
+		dailyAllowed, lifetimeAllowed, b.EndAt.Add(24*time.Hour).Unix()).Int()
+	if err != nil {
+		return false, err
+	}
+	return ok == 1, nil
+}
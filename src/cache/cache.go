@@ -3,87 +3,268 @@ package cache
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"main/utils"
+	"net/url"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
 )
 
-var RedisClient *redis.Client
+// a single node, cluster or sentinel client depending on the configuration, see NewClientFromEnv
+var RedisClient redis.UniversalClient
+
+// longest time a response stays cached
+const DefaultTTL = 5 * time.Minute
+
+// how long an expired response is still served while a single refresh replaces it,
+// configured by CACHE_STALE_TTL in seconds (default 30). 0 until Init
+var StaleTTL time.Duration
 
 func Init() {
+	prefix := "REDIS_"
 	if os.Getenv("APP_ENV") == "test" {
-		RedisClient = redis.NewClient(&redis.Options{
-			Addr:     os.Getenv("TEST_REDIS_HOST") + ":" + os.Getenv("TEST_REDIS_PORT"),
-			Password: os.Getenv("TEST_REDIS_PASSWORD"),
-		})
-	} else {
-		RedisClient = redis.NewClient(&redis.Options{
-			Addr:     os.Getenv("REDIS_HOST") + ":" + os.Getenv("REDIS_PORT"),
-			Password: os.Getenv("REDIS_PASSWORD"),
-		})
+		prefix = "TEST_REDIS_"
 	}
+
+	client, err := NewClientFromEnv(prefix)
+	if err != nil {
+		panic(err)
+	}
+	RedisClient = client
+
+	Breaker = newBreakerFromEnv()
+	RedisClient.AddHook(Breaker)
+
+	StaleTTL = 30 * time.Second
+	if seconds, err := strconv.Atoi(os.Getenv("CACHE_STALE_TTL")); err == nil && seconds >= 0 {
+		StaleTTL = time.Duration(seconds) * time.Second
+	}
+
+	Local = NewLocalCache(localCacheSize())
+	subscribeInvalidations()
+	watchGenerations()
 }
 
-func CacheMiddleware() gin.HandlerFunc {
+// runs the query and caches its result list again under the versioned key
+type RefreshFunc func(ctx context.Context, key string, params utils.PublicParams) error
+
+// keys being refreshed in the background by this instance
+var refreshing sync.Map
+
+// bind parses the query of the request, false when its response is never cached.
+// the cached result list is shared by every page of the query.
+// expired responses are served for StaleTTL more while refresh replaces them in the background
+func CacheMiddleware(bind func(c *gin.Context) (utils.PublicParams, bool), refresh RefreshFunc) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		key := c.Request.URL.Path + "?" + c.Request.URL.RawQuery
-		data, err, _ := utils.Sfg.Do(key, func() (interface{}, error) {
-			return RedisClient.Get(c, key).Result()
+		params, ok := bind(c)
+		if !ok {
+			c.Next()
+			return
+		}
+
+		key := VersionedKey(params.CacheKey(c.Request.URL.Path), params)
+		if entry, ok := Local.get(key); ok {
+			metrics.localHits.Add(1)
+			serveEntry(c, entry, params, refresh)
+			return
+		}
+
+		// prefixed so it is not shared with the database search of the same key.
+		// while the breaker is open this fails right away and the request goes to the database
+		data, err, _ := utils.Sfg.Do("redis:"+key, func() (interface{}, error) {
+			return getCache(c, key)
 		})
 
 		if err != nil {
+			metrics.misses.Add(1)
 			c.Next()
-		} else {
-			var jsondata []utils.Item
-			err := json.Unmarshal([]byte(data.(string)), &jsondata)
-			if err != nil {
-				c.Next()
-			}
-			c.JSON(200, jsondata)
-			c.Abort()
+			return
+		}
+
+		entry := data.(*localEntry)
+		Local.set(entry)
+		metrics.redisHits.Add(1)
+		serveEntry(c, entry, params, refresh)
+	}
+}
+
+func serveEntry(c *gin.Context, entry *localEntry, params utils.PublicParams, refresh RefreshFunc) {
+	if entry.stale() {
+		metrics.staleHits.Add(1)
+		refreshInBackground(entry.key, params, refresh)
+	}
+
+	entry.serve(c, params)
+	c.Abort()
+}
+
+// at most one refresh per key runs in this instance, the requests meanwhile get the stale response
+func refreshInBackground(key string, params utils.PublicParams, refresh RefreshFunc) {
+	if _, running := refreshing.LoadOrStore(key, true); running {
+		return
+	}
+
+	go func() {
+		defer refreshing.Delete(key)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		metrics.refreshes.Add(1)
+		if err := refresh(ctx, key, params); err != nil {
+			fmt.Println(err)
 		}
+	}()
+}
+
+// reads a cached response together with its remaining ttl, so the local copy expires with it
+func getCache(ctx context.Context, key string) (*localEntry, error) {
+	var get *redis.StringCmd
+	var pttl *redis.DurationCmd
+	_, err := RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, key)
+		pttl = pipe.PTTL(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var items []utils.Item
+	if err := json.Unmarshal([]byte(get.Val()), &items); err != nil {
+		return nil, err
+	}
+
+	ttl := pttl.Val()
+	if ttl <= 0 || ttl > DefaultTTL+StaleTTL {
+		ttl = DefaultTTL + StaleTTL
 	}
+	return newLocalEntry(key, items, ttl), nil
 }
 
-// key: url path with query parameters, value: the corresponding response
-func SetCache(ctx context.Context, key string, data []utils.Item) error {
+// bumped by every invalidation. a search remembers it before reading the database,
+// so a result read before an invalidation is never cached after it
+const generationKey = "cache:generation"
+
+// the current generation, to be passed to SetCache
+func Generation(ctx context.Context) (int64, error) {
+	generation, err := RedisClient.Get(ctx, generationKey).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return generation, err
+}
+
+// key: url path with the canonical query parameters and its version, see VersionedKey, value: the corresponding response.
+// ttl is capped at DefaultTTL, callers shorten it when the response is known to change earlier.
+// the key lives StaleTTL longer so it can be served while being refreshed.
+// generation is the one read before the search, the response is dropped again if an invalidation ran since
+func SetCache(ctx context.Context, key string, data []utils.Item, ttl time.Duration, generation int64) error {
+	if ttl <= 0 || ttl > DefaultTTL {
+		ttl = DefaultTTL
+	}
+
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
 
-	if _, err := RedisClient.Set(ctx, key, string(jsonData), 5*time.Minute).Result(); err != nil {
+	// kept locally even when redis is down, so this instance does not hit the database on every request
+	Local.Set(key, data, ttl+StaleTTL)
+
+	// the response and its index entry expire together, the index itself once its last key did.
+	// its expiry is only ever pushed back, a shorter response must not take the longer ones' entries with it
+	expires := time.Now().Add(ttl + StaleTTL)
+	var current *redis.StringCmd
+	_, err = RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, string(jsonData), ttl+StaleTTL)
+		pipe.ZAdd(ctx, indexKey, redis.Z{Score: float64(expires.UnixMilli()), Member: key})
+		pipe.Do(ctx, "pexpireat", indexKey, expires.UnixMilli(), "NX")
+		pipe.Do(ctx, "pexpireat", indexKey, expires.UnixMilli(), "GT")
+		current = pipe.Get(ctx, generationKey)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
 		return err
 	}
 
-	return nil
+	// the generation is read after the key is indexed: an invalidation that bumped it later
+	// finds the key in the index and deletes it itself
+	if n, _ := current.Int64(); n == generation {
+		return nil
+	}
+
+	Local.Delete(key)
+	if err := RedisClient.Del(ctx, key).Err(); err != nil {
+		return err
+	}
+	return publishInvalidation(ctx, []string{key})
 }
 
-// key: condition kind (age | country | gender | platform), value: list of cached url path with query parmeters
-func AddConditionCache(ctx context.Context, conditionKind, newKey string) error {
-	_, err := RedisClient.LPush(ctx, conditionKind, newKey).Result()
-	return err
+// key: cache:keys, a sorted set of every cached key scored by the unix milliseconds it expires at
+const indexKey = "cache:keys"
+
+// the targeting part of the query a cached key was stored for
+func ParseKey(key string) utils.PublicParams {
+	var p utils.PublicParams
+	u, err := url.Parse(key)
+	if err != nil {
+		return p
+	}
+	query := u.Query()
+	p.Age, _ = strconv.Atoi(query.Get("age"))
+	p.Gender = query.Get("gender")
+	p.Country = query.Get("country")
+	p.Platform = query.Get("platform")
+	return p
 }
 
-func DeleteConditionCache(ctx context.Context, key string) error {
-	// get the cached keys from all kinds of conditions
-	keys, err := RedisClient.LRange(ctx, key, 0, -1).Result()
+// deletes the cached responses whose query the match function accepts,
+// leaving the ones a change cannot affect in place
+func DeleteMatchingCache(ctx context.Context, match func(utils.PublicParams) bool) error {
+	// the local cache first, it is all this instance has while redis is down
+	Local.DeleteMatching(func(k string) bool { return match(ParseKey(k)) })
+
+	// the generation is bumped before the index is read, see SetCache
+	var keys *redis.StringSliceCmd
+	_, err := RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, generationKey)
+		pipe.ZRemRangeByScore(ctx, indexKey, "-inf", strconv.FormatInt(time.Now().UnixMilli(), 10))
+		keys = pipe.ZRange(ctx, indexKey, 0, -1)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	// delete the cached data
-	for _, k := range keys {
-		_, err = RedisClient.Del(ctx, k).Result()
-		if err != nil {
-			return err
+	matched := []string{}
+	for _, k := range keys.Val() {
+		if match(ParseKey(k)) {
+			matched = append(matched, k)
 		}
 	}
+	if len(matched) == 0 {
+		return nil
+	}
+
+	// one DEL per key, in cluster mode they can live on different slots
+	members := make([]interface{}, len(matched))
+	_, err = RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, k := range matched {
+			pipe.Del(ctx, k)
+			members[i] = k
+		}
+		pipe.ZRem(ctx, indexKey, members...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-	// delete the cached keys
-	_, err = RedisClient.Del(ctx, key).Result()
-	return err
+	return publishInvalidation(ctx, matched)
 }
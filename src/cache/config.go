@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// deployment modes of REDIS_MODE
+const (
+	ModeStandalone = "standalone"
+	ModeCluster    = "cluster"
+	ModeSentinel   = "sentinel"
+)
+
+// the redis client described by the environment variables with the given prefix (REDIS_ or TEST_REDIS_):
+//
+//	MODE: standalone (default) | cluster | sentinel
+//	ADDRS: comma separated node or sentinel addresses, HOST:PORT when not given
+//	MASTER_NAME, SENTINEL_PASSWORD: the monitored master of sentinel mode
+//	USERNAME, PASSWORD, DB
+//	TLS: true to connect over tls, TLS_CA_FILE to trust a private ca, TLS_SKIP_VERIFY for self signed certificates
+//	POOL_SIZE, MIN_IDLE_CONNS
+//	DIAL_TIMEOUT, READ_TIMEOUT, WRITE_TIMEOUT, POOL_TIMEOUT: durations such as 500ms or 3s
+func NewClientFromEnv(prefix string) (redis.UniversalClient, error) {
+	env := func(name string) string {
+		return os.Getenv(prefix + name)
+	}
+
+	opts := &redis.UniversalOptions{
+		Username:         env("USERNAME"),
+		Password:         env("PASSWORD"),
+		MasterName:       env("MASTER_NAME"),
+		SentinelPassword: env("SENTINEL_PASSWORD"),
+	}
+
+	if addrs := env("ADDRS"); addrs != "" {
+		for _, addr := range strings.Split(addrs, ",") {
+			opts.Addrs = append(opts.Addrs, strings.TrimSpace(addr))
+		}
+	} else {
+		opts.Addrs = []string{env("HOST") + ":" + env("PORT")}
+	}
+
+	ints := map[string]*int{"DB": &opts.DB, "POOL_SIZE": &opts.PoolSize, "MIN_IDLE_CONNS": &opts.MinIdleConns}
+	for name, field := range ints {
+		if raw := env(name); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s%s: %s", prefix, name, raw)
+			}
+			*field = n
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"DIAL_TIMEOUT":  &opts.DialTimeout,
+		"READ_TIMEOUT":  &opts.ReadTimeout,
+		"WRITE_TIMEOUT": &opts.WriteTimeout,
+		"POOL_TIMEOUT":  &opts.PoolTimeout,
+	}
+	for name, field := range durations {
+		if raw := env(name); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s%s: %s", prefix, name, raw)
+			}
+			*field = d
+		}
+	}
+
+	if env("TLS") == "true" {
+		config := &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: env("TLS_SKIP_VERIFY") == "true",
+		}
+		if file := env("TLS_CA_FILE"); file != "" {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in %s", file)
+			}
+		}
+		opts.TLSConfig = config
+	}
+
+	switch mode := env("MODE"); mode {
+	case "", ModeStandalone:
+		return redis.NewClient(opts.Simple()), nil
+	case ModeCluster:
+		if opts.DB != 0 {
+			return nil, errors.New("redis cluster only has db 0")
+		}
+		return redis.NewClusterClient(opts.Cluster()), nil
+	case ModeSentinel:
+		if opts.MasterName == "" {
+			return nil, fmt.Errorf("%sMASTER_NAME is required in sentinel mode", prefix)
+		}
+		return redis.NewFailoverClient(opts.Failover()), nil
+	default:
+		return nil, fmt.Errorf("invalid %sMODE: %s", prefix, mode)
+	}
+}
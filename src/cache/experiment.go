@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// key: variants:exposures | variants:clicks, field: variant id, value: count
+const (
+	variantExposuresKey = "variants:exposures"
+	variantClicksKey    = "variants:clicks"
+)
+
+func RecordExposures(ctx context.Context, variantIDs []uint) error {
+	if len(variantIDs) == 0 {
+		return nil
+	}
+
+	_, err := RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range variantIDs {
+			pipe.HIncrBy(ctx, variantExposuresKey, strconv.FormatUint(uint64(id), 10), 1)
+		}
+		return nil
+	})
+	return err
+}
+
+func RecordVariantClick(ctx context.Context, variantID uint) error {
+	return RedisClient.HIncrBy(ctx, variantClicksKey, strconv.FormatUint(uint64(variantID), 10), 1).Err()
+}
+
+// key: variant id, value: exposures and clicks recorded so far
+func VariantCounts(ctx context.Context, variantIDs []uint) (exposures, clicks map[uint]int64, err error) {
+	exposures, clicks = map[uint]int64{}, map[uint]int64{}
+	if len(variantIDs) == 0 {
+		return exposures, clicks, nil
+	}
+
+	fields := []string{}
+	for _, id := range variantIDs {
+		fields = append(fields, strconv.FormatUint(uint64(id), 10))
+	}
+
+	e, err := RedisClient.HMGet(ctx, variantExposuresKey, fields...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	cl, err := RedisClient.HMGet(ctx, variantClicksKey, fields...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, id := range variantIDs {
+		exposures[id] = parseCount(e[i])
+		clicks[id] = parseCount(cl[i])
+	}
+	return exposures, clicks, nil
+}
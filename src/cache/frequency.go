@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// max impressions of a banner per user, 0 means no cap
+type FrequencyCap struct {
+	BannerID uint
+	Hourly   int
+	Daily    int
+	Lifetime int
+	EndAt    time.Time
+}
+
+func (f FrequencyCap) IsCapped() bool {
+	return f.Hourly > 0 || f.Daily > 0 || f.Lifetime > 0
+}
+
+// key: freq:{user id}:banner id:window, value: impressions of the banner seen by the user in the window.
+// the user id is the hash tag so all counters of a user stay in the same cluster slot
+func frequencyKeys(userID string, bannerID uint, now time.Time) (hourly, daily, lifetime string) {
+	prefix := fmt.Sprintf("freq:{%s}:%d", userID, bannerID)
+	return prefix + ":h:" + now.Format("2006010215"), prefix + ":d:" + now.Format("20060102"), prefix + ":l"
+}
+
+// returns the ids of the banners the user has already seen as many times as their caps allow
+func CappedBanners(ctx context.Context, userID string, caps []FrequencyCap) (map[uint]bool, error) {
+	capped := map[uint]bool{}
+	now := time.Now()
+
+	keys := []string{}
+	limits := []int{}
+	owners := []uint{}
+	for _, f := range caps {
+		if !f.IsCapped() {
+			continue
+		}
+
+		hourly, daily, lifetime := frequencyKeys(userID, f.BannerID, now)
+		windows := []struct {
+			key   string
+			limit int
+		}{{hourly, f.Hourly}, {daily, f.Daily}, {lifetime, f.Lifetime}}
+
+		for _, w := range windows {
+			if w.limit > 0 {
+				keys = append(keys, w.key)
+				limits = append(limits, w.limit)
+				owners = append(owners, f.BannerID)
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return capped, nil
+	}
+
+	counts, err := RedisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, count := range counts {
+		s, ok := count.(string)
+		if !ok {
+			continue
+		}
+		if n, _ := strconv.Atoi(s); n >= limits[i] {
+			capped[owners[i]] = true
+		}
+	}
+
+	return capped, nil
+}
+
+// counts one impression of every banner whose windows are all below their caps, checking and counting
+// in one step so concurrent requests of the user cannot go over a cap. a window without a cap
+// has a limit of 0. all keys share the user's hash tag, so this also runs on a cluster
+var recordImpressionsScript = redis.NewScript(`
+local capped = {}
+for i = 1, #KEYS / 3 do
+	local k, a = (i - 1) * 3, (i - 1) * 4
+	local over = false
+	for w = 1, 3 do
+		local limit = tonumber(ARGV[a + w])
+		if limit > 0 and tonumber(redis.call('GET', KEYS[k + w]) or '0') >= limit then
+			over = true
+		end
+	end
+
+	if over then
+		capped[i] = 1
+	else
+		capped[i] = 0
+		redis.call('INCR', KEYS[k + 1])
+		redis.call('EXPIRE', KEYS[k + 1], 3600)
+		redis.call('INCR', KEYS[k + 2])
+		redis.call('EXPIRE', KEYS[k + 2], 86400)
+		redis.call('INCR', KEYS[k + 3])
+		redis.call('EXPIREAT', KEYS[k + 3], ARGV[a + 4])
+	end
+end
+return capped
+`)
+
+// counts one impression of each banner for the user and returns the ones that reached a cap in the
+// meantime, which are not counted and should not be served. uncapped banners are not tracked
+func RecordImpressions(ctx context.Context, userID string, caps []FrequencyCap) (map[uint]bool, error) {
+	capped := map[uint]bool{}
+	now := time.Now()
+
+	keys := []string{}
+	args := []interface{}{}
+	owners := []uint{}
+	for _, f := range caps {
+		if !f.IsCapped() {
+			continue
+		}
+
+		hourly, daily, lifetime := frequencyKeys(userID, f.BannerID, now)
+		keys = append(keys, hourly, daily, lifetime)
+		// the lifetime counter is useless once the banner has ended
+		args = append(args, f.Hourly, f.Daily, f.Lifetime, f.EndAt.Add(24*time.Hour).Unix())
+		owners = append(owners, f.BannerID)
+	}
+
+	if len(keys) == 0 {
+		return capped, nil
+	}
+
+	results, err := recordImpressionsScript.Run(ctx, RedisClient, keys, args...).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, result := range results {
+		if result == 1 {
+			capped[owners[i]] = true
+		}
+	}
+	return capped, nil
+}
@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"main/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// key: cache:generations, field: global | dimension | dimension:value, value: a counter folded into
+// every key it applies to, so bumping it moves those queries to keys nobody has cached yet
+const generationsKey = "cache:generations"
+
+// channel the bumped fields are published on, so every instance builds the new keys right away
+const generationsChannel = "cache:generations"
+
+// how often the generations are reloaded, in case a bump message was missed
+const generationsReload = 10 * time.Second
+
+// the dimensions that can be bumped on their own or per value
+var Dimensions = []string{"age", "gender", "country", "platform"}
+
+// the generations known to this instance, read on every request without asking redis
+var generations = struct {
+	sync.RWMutex
+	counts map[string]int64
+}{counts: map[string]int64{}}
+
+func IsValidDimension(dimension string) bool {
+	for _, d := range Dimensions {
+		if d == dimension {
+			return true
+		}
+	}
+	return false
+}
+
+// the value of a dimension in a query, empty when the query does not filter by it
+func dimensionValue(p utils.PublicParams, dimension string) string {
+	switch dimension {
+	case "age":
+		if p.Age != 0 {
+			return strconv.Itoa(p.Age)
+		}
+	case "gender":
+		return p.Gender
+	case "country":
+		return p.Country
+	case "platform":
+		return p.Platform
+	}
+	return ""
+}
+
+// the cache key of the query with every generation that applies to it, e.g. #v2.1-3 for the global one
+// and then the dimension and value ones of each dimension the query filters by, in the order of Dimensions.
+// the key already tells which dimensions those are, so two different sets of counters never share a key
+func VersionedKey(key string, p utils.PublicParams) string {
+	generations.RLock()
+	defer generations.RUnlock()
+
+	version := strconv.FormatInt(generations.counts["global"], 10)
+	for _, d := range Dimensions {
+		if value := dimensionValue(p, d); value != "" {
+			version += "." + strconv.FormatInt(generations.counts[d], 10) + "-" + strconv.FormatInt(generations.counts[d+":"+value], 10)
+		}
+	}
+	return key + "#v" + version
+}
+
+// reads every generation from redis. a bump may have arrived after the read,
+// so each counter only moves forward, see setGeneration
+func LoadGenerations(ctx context.Context) error {
+	all, err := RedisClient.HGetAll(ctx, generationsKey).Result()
+	if err != nil {
+		return err
+	}
+
+	for field, raw := range all {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			continue
+		}
+		setGeneration(field, n)
+	}
+	return nil
+}
+
+func setGeneration(field string, n int64) {
+	generations.Lock()
+	defer generations.Unlock()
+
+	// a reload can race a bump message, never go back
+	if n > generations.counts[field] {
+		generations.counts[field] = n
+	}
+}
+
+// invalidates every cached query at once when dimension is empty, every query filtering by the
+// dimension when value is empty, or else every query filtering by that value, e.g. country TW
+func BumpGeneration(ctx context.Context, dimension, value string) (int64, error) {
+	field := "global"
+	if dimension != "" {
+		if !IsValidDimension(dimension) {
+			return 0, fmt.Errorf("invalid dimension: %s", dimension)
+		}
+		field = dimension
+		if value != "" {
+			field += ":" + value
+		}
+	}
+
+	n, err := RedisClient.HIncrBy(ctx, generationsKey, field, 1).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	setGeneration(field, n)
+	if err := RedisClient.Publish(ctx, generationsChannel, field+"="+strconv.FormatInt(n, 10)).Err(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func applyGenerationMessage(payload string) {
+	field, raw, ok := strings.Cut(payload, "=")
+	if !ok {
+		return
+	}
+	if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		setGeneration(field, n)
+	}
+}
+
+// keeps the generations of this instance up to date, for as long as the process runs
+func watchGenerations() {
+	if err := LoadGenerations(context.Background()); err != nil {
+		fmt.Println(err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(generationsReload)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := LoadGenerations(context.Background()); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,255 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"main/utils"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// channel the deleted keys are published on, so every instance drops them from its local cache
+const invalidationChannel = "cache:invalidate"
+
+// in-process tier in front of redis, keyed the same way. disabled until Init
+var Local = NewLocalCache(0)
+
+// max entries kept in the local cache, configured by LOCAL_CACHE_SIZE (default 1024, 0 disables it)
+func localCacheSize() int {
+	if size, err := strconv.Atoi(os.Getenv("LOCAL_CACHE_SIZE")); err == nil && size >= 0 {
+		return size
+	}
+	return 1024
+}
+
+// most serialized pages kept per entry
+const maxLocalPages = 16
+
+type localEntry struct {
+	key     string
+	expires time.Time
+	items   []utils.Item
+	// whether every item has at most one creative, so a page is the same on every serve
+	fixed bool
+
+	mu sync.Mutex
+	// key: offset:limit, value: the serialized page
+	pages map[string][]byte
+}
+
+// ttl includes the StaleTTL the entry is served for after going stale
+func newLocalEntry(key string, items []utils.Item, ttl time.Duration) *localEntry {
+	entry := &localEntry{key: key, expires: time.Now().Add(ttl), items: items, fixed: true, pages: map[string][]byte{}}
+	for _, item := range items {
+		if len(item.Creatives) > 1 {
+			entry.fixed = false
+			break
+		}
+	}
+	return entry
+}
+
+func (e *localEntry) stale() bool {
+	return time.Now().After(e.expires.Add(-StaleTTL))
+}
+
+// the page of a fixed entry is serialized once, otherwise a creative is picked on every serve
+func (e *localEntry) serve(c *gin.Context, p utils.PublicParams) {
+	page := p.Page(e.items)
+	if !e.fixed {
+		c.JSON(200, utils.ChooseCreatives(page))
+		return
+	}
+
+	pageKey := fmt.Sprintf("%d:%d", p.Offset, p.Limit)
+	e.mu.Lock()
+	body, ok := e.pages[pageKey]
+	e.mu.Unlock()
+
+	if !ok {
+		var err error
+		if body, err = json.Marshal(utils.ChooseCreatives(page)); err != nil {
+			c.JSON(200, utils.ChooseCreatives(page))
+			return
+		}
+
+		e.mu.Lock()
+		if len(e.pages) < maxLocalPages {
+			e.pages[pageKey] = body
+		}
+		e.mu.Unlock()
+	}
+
+	c.Data(200, "application/json; charset=utf-8", body)
+}
+
+// least recently used entries are dropped first once size is reached
+type LocalCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func NewLocalCache(size int) *LocalCache {
+	return &LocalCache{size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (l *LocalCache) get(key string) (*localEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	elem, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*localEntry)
+	if time.Now().After(entry.expires) {
+		l.order.Remove(elem)
+		delete(l.entries, key)
+		return nil, false
+	}
+
+	l.order.MoveToFront(elem)
+	return entry, true
+}
+
+func (l *LocalCache) set(entry *localEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.size == 0 {
+		return
+	}
+
+	if elem, ok := l.entries[entry.key]; ok {
+		elem.Value = entry
+		l.order.MoveToFront(elem)
+		return
+	}
+
+	l.entries[entry.key] = l.order.PushFront(entry)
+	for l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*localEntry).key)
+	}
+}
+
+// whether a live entry is cached for the key
+func (l *LocalCache) Has(key string) bool {
+	_, ok := l.get(key)
+	return ok
+}
+
+func (l *LocalCache) Set(key string, items []utils.Item, ttl time.Duration) {
+	l.set(newLocalEntry(key, items, ttl))
+}
+
+func (l *LocalCache) Delete(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, k := range keys {
+		if elem, ok := l.entries[k]; ok {
+			l.order.Remove(elem)
+			delete(l.entries, k)
+		}
+	}
+}
+
+// drops the keys the match function accepts
+func (l *LocalCache) DeleteMatching(match func(key string) bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for k, elem := range l.entries {
+		if match(k) {
+			l.order.Remove(elem)
+			delete(l.entries, k)
+		}
+	}
+}
+
+func (l *LocalCache) Purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.order.Init()
+	l.entries = map[string]*list.Element{}
+}
+
+func (l *LocalCache) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.order.Len()
+}
+
+// tells the other instances to drop the keys from their local cache
+func publishInvalidation(ctx context.Context, keys []string) error {
+	_, err := RedisClient.Publish(ctx, invalidationChannel, strings.Join(keys, "\n")).Result()
+	return err
+}
+
+// channel the ids of written banners are published on as origin:id, so every instance with the banner index reloads them
+const bannersChannel = "cache:banners"
+
+// calls apply with the id of every banner the other watchers publish, for as long as the process runs.
+// the returned function publishes a banner written by this watcher, which is not applied here again
+func WatchBannerChanges(apply func(id uint)) (publish func(ctx context.Context, id uint) error) {
+	origin, err := randomToken()
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	sub := RedisClient.Subscribe(context.Background(), bannersChannel)
+	// waits for the subscription, so the writes right after it are not missed
+	if _, err := sub.Receive(context.Background()); err != nil {
+		fmt.Println(err)
+	}
+	go func() {
+		defer sub.Close()
+
+		for msg := range sub.Channel() {
+			from, raw, ok := strings.Cut(msg.Payload, ":")
+			if !ok || from == origin {
+				continue
+			}
+			if id, err := strconv.ParseUint(raw, 10, 64); err == nil {
+				apply(uint(id))
+			}
+		}
+		fmt.Println("banner change subscription closed")
+	}()
+
+	return func(ctx context.Context, id uint) error {
+		return RedisClient.Publish(ctx, bannersChannel, origin+":"+strconv.FormatUint(uint64(id), 10)).Err()
+	}
+}
+
+// drops the keys other instances invalidated and picks up the generations they bumped,
+// for as long as the process runs
+func subscribeInvalidations() {
+	sub := RedisClient.Subscribe(context.Background(), invalidationChannel, generationsChannel)
+	go func() {
+		defer sub.Close()
+
+		for msg := range sub.Channel() {
+			if msg.Channel == generationsChannel {
+				applyGenerationMessage(msg.Payload)
+				continue
+			}
+			Local.Delete(strings.Split(msg.Payload, "\n")...)
+		}
+		fmt.Println("cache invalidation subscription closed")
+	}()
+}
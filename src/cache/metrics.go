@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var metrics struct {
+	localHits    atomic.Uint64
+	redisHits    atomic.Uint64
+	staleHits    atomic.Uint64
+	misses       atomic.Uint64
+	refreshes    atomic.Uint64
+	breakerOpens atomic.Uint64
+}
+
+type CacheMetrics struct {
+	LocalHits uint64 `json:"localHits"`
+	RedisHits uint64 `json:"redisHits"`
+	// served after their ttl while a refresh runs
+	StaleHits uint64 `json:"staleHits"`
+	Misses    uint64 `json:"misses"`
+	Refreshes uint64 `json:"refreshes"`
+	// times redis was cut off by the circuit breaker
+	BreakerOpens uint64 `json:"breakerOpens"`
+	// whether redis is cut off and requests are served from the local cache and the database only
+	Fallback      bool       `json:"fallback"`
+	FallbackSince *time.Time `json:"fallbackSince,omitempty"`
+}
+
+// counters since the process started
+func Metrics() CacheMetrics {
+	m := CacheMetrics{
+		LocalHits:    metrics.localHits.Load(),
+		RedisHits:    metrics.redisHits.Load(),
+		StaleHits:    metrics.staleHits.Load(),
+		Misses:       metrics.misses.Load(),
+		Refreshes:    metrics.refreshes.Load(),
+		BreakerOpens: metrics.breakerOpens.Load(),
+	}
+
+	if open, since := Breaker.Open(); open {
+		m.Fallback = true
+		m.FallbackSince = &since
+	}
+	return m
+}
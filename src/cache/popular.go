@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// key: popular:YYYYMMDD, a sorted set of the cache keys missed that day, scored by the misses
+func popularKey(day time.Time) string {
+	return "popular:" + day.Format("20060102")
+}
+
+// counts a cache miss of the key, so warming knows which queries are asked for
+func RecordQuery(ctx context.Context, key string) error {
+	day := popularKey(time.Now())
+	_, err := RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZIncrBy(ctx, day, 1, key)
+		pipe.Expire(ctx, day, 48*time.Hour)
+		return nil
+	})
+	return err
+}
+
+// the n cache keys missed most often today and yesterday
+func PopularQueries(ctx context.Context, n int) ([]string, error) {
+	now := time.Now()
+	scores := map[string]float64{}
+	for _, day := range []time.Time{now, now.AddDate(0, 0, -1)} {
+		top, err := RedisClient.ZRevRangeWithScores(ctx, popularKey(day), 0, int64(n-1)).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, z := range top {
+			scores[z.Member.(string)] += z.Score
+		}
+	}
+
+	keys := make([]string, 0, len(scores))
+	for k := range scores {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if scores[keys[i]] != scores[keys[j]] {
+			return scores[keys[i]] > scores[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys, nil
+}
+
+// whether a response is cached in redis for the key
+func IsCached(ctx context.Context, key string) (bool, error) {
+	n, err := RedisClient.Exists(ctx, key).Result()
+	return n != 0, err
+}
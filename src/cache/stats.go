@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	EventImpression = "impression"
+	EventClick      = "click"
+)
+
+// key: {stats}:pending, field: banner id:day:event, value: count not yet flushed to the database.
+// a flush renames it to {stats}:flushing so new events keep landing in a fresh hash.
+// the shared hash tag keeps both on one cluster slot, which RENAME needs
+const (
+	pendingStatsKey  = "{stats}:pending"
+	flushingStatsKey = "{stats}:flushing"
+	statsLockKey     = "{stats}:lock"
+)
+
+// longer than any flush takes, so a replica that dies while flushing does not block the others for good
+const statsLockTTL = 5 * time.Minute
+
+type StatCount struct {
+	BannerID uint
+	Day      time.Time
+	Event    string
+	Count    int64
+}
+
+func RecordEvent(ctx context.Context, bannerID uint, event string) error {
+	field := fmt.Sprintf("%d:%s:%s", bannerID, time.Now().Format("2006-01-02"), event)
+	return RedisClient.HIncrBy(ctx, pendingStatsKey, field, 1).Err()
+}
+
+// claims the flush for this replica, every replica runs the flusher and two of them
+// reading the same batch would count it twice. ok is false while another one holds it
+func LockStats(ctx context.Context) (token string, ok bool, err error) {
+	token, err = randomToken()
+	if err != nil {
+		return "", false, err
+	}
+
+	ok, err = RedisClient.SetNX(ctx, statsLockKey, token, statsLockTTL).Result()
+	return token, ok, err
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// only deletes the lock if it is still ours, it may have expired and been taken by another replica
+var unlockStatsScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func UnlockStats(ctx context.Context, token string) error {
+	return unlockStatsScript.Run(ctx, RedisClient, []string{statsLockKey}, token).Err()
+}
+
+// moves the pending counters aside and returns them, a batch left over by a failed flush is returned first.
+// the batch stays in redis until AckStats is called, callers hold the lock from LockStats
+func PopStats(ctx context.Context) ([]StatCount, error) {
+	n, err := RedisClient.Exists(ctx, flushingStatsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if n == 0 {
+		// nothing was recorded since the last flush
+		if err := RedisClient.Rename(ctx, pendingStatsKey, flushingStatsKey).Err(); err != nil {
+			if strings.Contains(err.Error(), "no such key") {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+
+	fields, err := RedisClient.HGetAll(ctx, flushingStatsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []StatCount
+	for field, value := range fields {
+		parts := strings.Split(field, ":")
+		if len(parts) != 3 {
+			continue
+		}
+
+		id, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		day, err := time.ParseInLocation("2006-01-02", parts[1], time.Local)
+		if err != nil {
+			continue
+		}
+		count, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		stats = append(stats, StatCount{BannerID: uint(id), Day: day, Event: parts[2], Count: count})
+	}
+
+	return stats, nil
+}
+
+// drops the batch returned by PopStats once it is stored
+func AckStats(ctx context.Context) error {
+	return RedisClient.Del(ctx, flushingStatsKey).Err()
+}
@@ -1,50 +1,45 @@
 package controllers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"main/cache"
 	"main/models"
 	"main/utils"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/biter777/countries"
 	"github.com/gin-gonic/gin"
 )
 
-func CreateBanner(c *gin.Context) {
-	var adminParams utils.AdminParams
-
-	if err := c.Bind(&adminParams); err != nil {
-		fmt.Println(err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
-		return
-	}
+// where the banners and their creatives are kept, set by routers.Init
+var Store models.BannerStore
 
+func validateAdminParams(adminParams *utils.AdminParams) error {
 	if adminParams.Title == "" || adminParams.StartAt.IsZero() || adminParams.EndAt.IsZero() {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Title, startAt and endAt are required"})
-		return
+		return errors.New("Title, startAt and endAt are required")
 	}
 
 	if adminParams.StartAt.After(adminParams.EndAt) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "StartAt must be before EndAt"})
-		return
+		return errors.New("StartAt must be before EndAt")
 	}
 
 	if adminParams.Conditions.AgeStart < 0 || adminParams.Conditions.AgeEnd > 100 || adminParams.Conditions.AgeStart > adminParams.Conditions.AgeEnd {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid age range"})
-		return
+		return errors.New("Invalid age range")
 	}
 
 	if (adminParams.Conditions.AgeStart == 0 || adminParams.Conditions.AgeEnd == 0) && adminParams.Conditions.AgeStart != adminParams.Conditions.AgeEnd {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid age range"})
-		return
+		return errors.New("Invalid age range")
 	}
 
 	if adminParams.Conditions.Gender != nil {
 		for _, g := range adminParams.Conditions.Gender {
-			if g != "M" && g != "F" {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid gender"})
-				return
+			if !isValidGender(g) {
+				return errors.New("Invalid gender")
 			}
 		}
 	} else {
@@ -53,9 +48,8 @@ func CreateBanner(c *gin.Context) {
 
 	if adminParams.Conditions.Country != nil {
 		for _, country := range adminParams.Conditions.Country {
-			if countries.ByName(country) == countries.Unknown {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid country"})
-				return
+			if !isValidCountry(country) {
+				return errors.New("Invalid country")
 			}
 		}
 	} else {
@@ -64,95 +58,700 @@ func CreateBanner(c *gin.Context) {
 
 	if adminParams.Conditions.Platform != nil {
 		for _, platform := range adminParams.Conditions.Platform {
-			if platform != "ios" && platform != "android" && platform != "web" {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid platform"})
-				return
+			if !isValidPlatform(platform) {
+				return errors.New("Invalid platform")
 			}
 		}
 	} else {
 		adminParams.Conditions.Platform = []string{}
 	}
 
-	if err := models.CreateBanner(adminParams); err != nil {
+	if adminParams.Conditions.ExcludeGender != nil {
+		for _, g := range adminParams.Conditions.ExcludeGender {
+			if !isValidGender(g) {
+				return errors.New("Invalid gender")
+			}
+		}
+	} else {
+		adminParams.Conditions.ExcludeGender = []string{}
+	}
+
+	if adminParams.Conditions.ExcludeCountry != nil {
+		for _, country := range adminParams.Conditions.ExcludeCountry {
+			if !isValidCountry(country) {
+				return errors.New("Invalid country")
+			}
+		}
+	} else {
+		adminParams.Conditions.ExcludeCountry = []string{}
+	}
+
+	if adminParams.Conditions.ExcludePlatform != nil {
+		for _, platform := range adminParams.Conditions.ExcludePlatform {
+			if !isValidPlatform(platform) {
+				return errors.New("Invalid platform")
+			}
+		}
+	} else {
+		adminParams.Conditions.ExcludePlatform = []string{}
+	}
+
+	if overlaps(adminParams.Conditions.Gender, adminParams.Conditions.ExcludeGender) ||
+		overlaps(adminParams.Conditions.Country, adminParams.Conditions.ExcludeCountry) ||
+		overlaps(adminParams.Conditions.Platform, adminParams.Conditions.ExcludePlatform) {
+		return errors.New("A condition cannot be both targeted and excluded")
+	}
+
+	for _, schedule := range adminParams.Schedules {
+		if err := validateSchedule(schedule); err != nil {
+			return err
+		}
+	}
+
+	if adminParams.Priority < 0 {
+		return errors.New("Invalid priority")
+	}
+
+	if adminParams.Weight < 0 {
+		return errors.New("Invalid weight")
+	}
+
+	if adminParams.FrequencyCap.Hour < 0 || adminParams.FrequencyCap.Day < 0 || adminParams.FrequencyCap.Lifetime < 0 {
+		return errors.New("Invalid frequency cap")
+	}
+
+	if adminParams.Budget.Daily < 0 || adminParams.Budget.Lifetime < 0 {
+		return errors.New("Invalid budget")
+	}
+
+	if adminParams.Weight == 0 {
+		adminParams.Weight = 1
+	}
+
+	if adminParams.CreativeRotation == "" {
+		adminParams.CreativeRotation = models.RotationEven
+	}
+
+	if adminParams.CreativeRotation != models.RotationEven && adminParams.CreativeRotation != models.RotationWeighted {
+		return errors.New("Invalid creative rotation")
+	}
+
+	return nil
+}
+
+func validateSchedule(schedule utils.ScheduleParams) error {
+	if len(schedule.Days) == 0 {
+		return errors.New("Schedule days are required")
+	}
+
+	for _, d := range schedule.Days {
+		if _, ok := models.ParseWeekday(d); !ok {
+			return errors.New("Invalid schedule day")
+		}
+	}
+
+	start, ok := models.ParseClock(schedule.Start)
+	if !ok || start == 24*60 {
+		return errors.New("Invalid schedule time")
+	}
+
+	end, ok := models.ParseClock(schedule.End)
+	if !ok {
+		return errors.New("Invalid schedule time")
+	}
+
+	if start == end {
+		return errors.New("Schedule start and end must differ")
+	}
+
+	return nil
+}
+
+func isValidGender(gender string) bool {
+	return gender == "M" || gender == "F"
+}
+
+func isValidCountry(country string) bool {
+	return countries.ByName(country) != countries.Unknown
+}
+
+func isValidPlatform(platform string) bool {
+	return platform == "ios" || platform == "android" || platform == "web"
+}
+
+func overlaps(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// delete the cached responses the given banner conditions can appear in, old and new ones on updates
+func deleteRelatedCache(c *gin.Context, conditions ...utils.ConditionParams) {
+	cache.DeleteMatchingCache(c, func(p utils.PublicParams) bool {
+		for _, cond := range conditions {
+			if cond.Matches(p) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ranking strategy used when the request does not ask for one, configured by AD_RANK
+func defaultRank() string {
+	if rank := os.Getenv("AD_RANK"); rank != "" {
+		return rank
+	}
+	return models.RankPriority
+}
+
+// cached responses must not outlive the next schedule boundary,
+// nor the start or end of any banner the query can match
+func responseTTL(publicParams utils.PublicParams) time.Duration {
+	ttl := cache.DefaultTTL
+	now := time.Now()
+
+	next, ok, err := Store.NextScheduleChange(now.In(publicParams.Location()))
+	if err != nil {
+		fmt.Println(err)
+		return ttl
+	}
+
+	if ok && next < ttl {
+		ttl = next
+	}
+
+	boundary, ok, err := Store.NextBannerBoundary(publicParams, now)
+	if err != nil {
+		fmt.Println(err)
+		return ttl
+	}
+
+	if d := boundary.Sub(now); ok && d < ttl {
+		// a key that expires right at the boundary is refreshed by the first request after it
+		ttl = d + time.Second
+	}
+
+	// another instance's write can be missing from the store's search for a while
+	if bound := Store.MaxStaleness(); bound > 0 && bound < ttl {
+		ttl = bound
+	}
+	return ttl
+}
+
+func parseBannerID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func CreateBanner(c *gin.Context) {
+	var adminParams utils.AdminParams
+
+	if err := c.Bind(&adminParams); err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if err := validateAdminParams(&adminParams); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// a new banner can only start its lifecycle in one of these states
+	if adminParams.Status != "" && adminParams.Status != models.StatusDraft &&
+		adminParams.Status != models.StatusScheduled && adminParams.Status != models.StatusActive {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+
+	id, err := Store.CreateBanner(actor(c), adminParams)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return
 	}
 
 	// delete related cache
-	if adminParams.Conditions.AgeStart != 0 {
-		cache.DeleteConditionCache(c, "age")
+	deleteRelatedCache(c, adminParams.Conditions)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Banner created", "id": id})
+}
+
+func GetBanner(c *gin.Context) {
+	id, ok := parseBannerID(c)
+	if !ok {
+		return
 	}
-	if len(adminParams.Conditions.Country) != 0 {
-		cache.DeleteConditionCache(c, "country")
+
+	banner, err := Store.GetBanner(id)
+	if errors.Is(err, models.ErrBannerNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Banner not found"})
+		return
 	}
-	if len(adminParams.Conditions.Gender) != 0 {
-		cache.DeleteConditionCache(c, "gender")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, banner.Detail())
+}
+
+func ListBanners(c *gin.Context) {
+	var listParams utils.ListParams
+	if err := c.ShouldBind(&listParams); err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if listParams.Limit < 0 || listParams.Offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pagination"})
+		return
+	}
+
+	if listParams.Limit == 0 {
+		listParams.Limit = 20
+	}
+
+	banners, total, err := Store.ListBanners(listParams)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
 	}
-	if len(adminParams.Conditions.Platform) != 0 {
-		cache.DeleteConditionCache(c, "platform")
+
+	list := utils.BannerList{Data: []utils.BannerDetail{}, Total: total}
+	for _, b := range banners {
+		list.Data = append(list.Data, b.Detail())
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Banner created"})
+	c.JSON(http.StatusOK, list)
 }
 
-func SearchBanners(c *gin.Context) {
-	var publicParams utils.PublicParams
-	if err := c.ShouldBind(&publicParams); err != nil {
+// PUT replaces the whole banner, PATCH only overwrites the fields present in the body
+func UpdateBanner(c *gin.Context) {
+	id, ok := parseBannerID(c)
+	if !ok {
+		return
+	}
+
+	banner, err := Store.GetBanner(id)
+	if errors.Is(err, models.ErrBannerNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Banner not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	old := banner.Detail().AdminParams
+	var adminParams utils.AdminParams
+	if c.Request.Method == http.MethodPatch {
+		adminParams = banner.Detail().AdminParams
+	}
+
+	if err := c.ShouldBindJSON(&adminParams); err != nil {
 		fmt.Println(err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
 
-	if publicParams.Age < 0 || publicParams.Age > 100 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid age"})
+	if err := validateAdminParams(&adminParams); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if publicParams.Country != "" && countries.ByName(publicParams.Country) == countries.Unknown {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid country"})
+	if adminParams.Status != "" && adminParams.Status != old.Status {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Status can only be changed through the status endpoint"})
 		return
 	}
 
-	if publicParams.Gender != "" && publicParams.Gender != "M" && publicParams.Gender != "F" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid gender"})
+	err = Store.UpdateBanner(actor(c), id, adminParams)
+	if errors.Is(err, models.ErrBannerNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Banner not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return
 	}
 
-	if publicParams.Platform != "" && publicParams.Platform != "ios" && publicParams.Platform != "android" && publicParams.Platform != "web" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid platform"})
+	// the banner may leave the results it used to match and enter new ones
+	deleteRelatedCache(c, old.Conditions, adminParams.Conditions)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Banner updated"})
+}
+
+func TransitionBanner(c *gin.Context) {
+	id, ok := parseBannerID(c)
+	if !ok {
 		return
 	}
 
+	var statusParams utils.StatusParams
+	if err := c.ShouldBind(&statusParams); err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if !models.IsValidStatus(statusParams.Status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+
+	banner, err := Store.TransitionBanner(actor(c), id, statusParams.Status)
+	if errors.Is(err, models.ErrBannerNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Banner not found"})
+		return
+	}
+	if errors.Is(err, models.ErrInvalidTransition) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Cannot move banner from %s to %s", banner.Status, statusParams.Status)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	deleteRelatedCache(c, banner.Detail().Conditions)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Banner status updated", "status": statusParams.Status})
+}
+
+func DeleteBanner(c *gin.Context) {
+	id, ok := parseBannerID(c)
+	if !ok {
+		return
+	}
+
+	banner, err := Store.GetBanner(id)
+	if errors.Is(err, models.ErrBannerNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Banner not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	err = Store.DeleteBanner(actor(c), id)
+	if errors.Is(err, models.ErrBannerNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Banner not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	deleteRelatedCache(c, banner.Detail().Conditions)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Banner deleted"})
+}
+
+// binds the public query of the request, see validatePublicParams
+func bindPublicParams(c *gin.Context) (utils.PublicParams, string) {
+	var publicParams utils.PublicParams
+	if err := c.ShouldBind(&publicParams); err != nil {
+		fmt.Println(err)
+		return publicParams, "Invalid request"
+	}
+
+	msg := validatePublicParams(&publicParams)
+	return publicParams, msg
+}
+
+// applies the defaults of a bound public query. an empty message means it is valid
+func validatePublicParams(publicParams *utils.PublicParams) string {
+	if publicParams.Age < 0 || publicParams.Age > 100 {
+		return "Invalid age"
+	}
+
+	if publicParams.Country != "" && countries.ByName(publicParams.Country) == countries.Unknown {
+		return "Invalid country"
+	}
+
+	if publicParams.Gender != "" && publicParams.Gender != "M" && publicParams.Gender != "F" {
+		return "Invalid gender"
+	}
+
+	if publicParams.Platform != "" && publicParams.Platform != "ios" && publicParams.Platform != "android" && publicParams.Platform != "web" {
+		return "Invalid platform"
+	}
+
+	if publicParams.Timezone != "" {
+		if _, err := time.LoadLocation(publicParams.Timezone); err != nil {
+			return "Invalid tz"
+		}
+	}
+
+	if len(publicParams.UserID) > 64 {
+		return "Invalid userId"
+	}
+
 	if publicParams.Limit == 0 {
 		publicParams.Limit = 5
 	}
 
-	// single flight
-	key := c.Request.URL.Path + "?" + c.Request.URL.RawQuery
+	if publicParams.Rank == "" {
+		publicParams.Rank = defaultRank()
+	}
+
+	if !models.IsValidRank(publicParams.Rank) {
+		return "Invalid rank"
+	}
+
+	return ""
+}
+
+// the public query to look up in the cache, false when it is invalid or its response is never cached
+func CacheableParams(c *gin.Context) (utils.PublicParams, bool) {
+	publicParams, msg := bindPublicParams(c)
+	if msg != "" || publicParams.UserID != "" || publicParams.Rank == models.RankWeighted {
+		return publicParams, false
+	}
+	return publicParams, true
+}
+
+func SearchBanners(c *gin.Context) {
+	publicParams, msg := bindPublicParams(c)
+	if msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	if publicParams.UserID != "" {
+		searchBannersForUser(c, publicParams)
+		return
+	}
+
+	if publicParams.Rank == models.RankWeighted {
+		searchBannersUncached(c, publicParams)
+		return
+	}
+
+	query := publicParams.CacheKey(c.Request.URL.Path)
+	key := cache.VersionedKey(query, publicParams)
+	result, err := searchAndCache(c, key, publicParams)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	if result.cacheable(publicParams) {
+		// cache misses tell the warming which queries are popular, whatever their version
+		if err := cache.RecordQuery(c, query); err != nil {
+			fmt.Println(err)
+		}
+	} else {
+		item := spendBudgets(c, searchResult{publicParams.Page(result.items), result.budgets})
+		c.JSON(http.StatusOK, utils.ChooseCreatives(item))
+		return
+	}
+
+	c.JSON(http.StatusOK, utils.ChooseCreatives(publicParams.Page(result.items)))
+}
+
+// refreshes a stale cached query in the background
+func RefreshSearch(ctx context.Context, key string, publicParams utils.PublicParams) error {
+	_, err := searchAndCache(ctx, key, publicParams)
+	return err
+}
+
+// searches once for concurrent requests of the same query and caches the whole list when it can be
+func searchAndCache(ctx context.Context, key string, publicParams utils.PublicParams) (searchResult, error) {
 	data, err, _ := utils.Sfg.Do(key, func() (interface{}, error) {
-		return models.SearchBanner(publicParams)
+		// read before the database, see cache.SetCache. when redis is down the response is only
+		// cached locally, and if it fails just here the mismatch drops the response from redis again
+		generation, err := cache.Generation(ctx)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		budgets := map[uint]cache.Budget{}
+		items, err := Store.SearchBanner(publicParams, budgetFilter(ctx, budgets))
+		if err != nil {
+			return nil, err
+		}
+
+		result := searchResult{items, budgets}
+		if result.cacheable(publicParams) {
+			// the whole list is cached, every page of the query is served from it
+			if err := cache.SetCache(ctx, key, items, responseTTL(publicParams), generation); err != nil {
+				fmt.Println(err)
+			}
+		}
+		return result, nil
 	})
+	if err != nil {
+		return searchResult{}, err
+	}
+	return data.(searchResult), nil
+}
+
+// weighted results are drawn anew for every request, so concurrent ones do not share a search either
+func searchBannersUncached(c *gin.Context, publicParams utils.PublicParams) {
+	budgets := map[uint]cache.Budget{}
+	items, err := Store.SearchBanner(publicParams, budgetFilter(c, budgets))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	items = spendBudgets(c, searchResult{publicParams.Page(items), budgets})
+	c.JSON(http.StatusOK, utils.ChooseCreatives(items))
+}
+
+// serves an identified user, skipping the banners that reached their frequency caps
+// and counting an impression of every served one. these responses are never cached
+func searchBannersForUser(c *gin.Context, publicParams utils.PublicParams) {
+	caps := map[uint]cache.FrequencyCap{}
 
-	item := data.([]utils.Item)
+	capFilter := func(banners []models.Banner) ([]models.Banner, error) {
+		list := []cache.FrequencyCap{}
+		for _, b := range banners {
+			f := cache.FrequencyCap{BannerID: b.ID, Hourly: b.CapHourly, Daily: b.CapDaily, Lifetime: b.CapLifetime, EndAt: b.EndAt}
+			if f.IsCapped() {
+				caps[b.ID] = f
+				list = append(list, f)
+			}
+		}
+
+		capped, err := cache.CappedBanners(c, publicParams.UserID, list)
+		if err != nil {
+			// serve without capping rather than failing the request
+			fmt.Println(err)
+			return banners, nil
+		}
+
+		filtered := []models.Banner{}
+		for _, b := range banners {
+			if !capped[b.ID] {
+				filtered = append(filtered, b)
+			}
+		}
+		return filtered, nil
+	}
+
+	budgets := map[uint]cache.Budget{}
+	item, err := Store.SearchBanner(publicParams, capFilter, budgetFilter(c, budgets))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return
 	}
 
-	cache.SetCache(c, key, item)
+	item = spendBudgets(c, searchResult{publicParams.Page(item), budgets})
+	item = recordImpressions(c, publicParams.UserID, caps, item)
+	item = applyExperiments(c, publicParams.UserID, item)
+
+	c.JSON(http.StatusOK, utils.ChooseCreatives(item))
+}
+
+// counts an impression of every served banner with a cap, dropping the ones a concurrent request
+// of the user took to their cap after the filter
+func recordImpressions(c *gin.Context, userID string, caps map[uint]cache.FrequencyCap, items []utils.Item) []utils.Item {
+	served := []cache.FrequencyCap{}
+	for _, i := range items {
+		if f, ok := caps[i.ID]; ok {
+			served = append(served, f)
+		}
+	}
+	if len(served) == 0 {
+		return items
+	}
 
-	if publicParams.Age != 0 {
-		cache.AddConditionCache(c, "age", key)
+	capped, err := cache.RecordImpressions(c, userID, served)
+	if err != nil {
+		// serve without capping rather than failing the request
+		fmt.Println(err)
+		return items
 	}
-	if publicParams.Country != "" {
-		cache.AddConditionCache(c, "country", key)
+
+	var kept []utils.Item
+	for _, i := range items {
+		if !capped[i.ID] {
+			kept = append(kept, i)
+		}
 	}
-	if publicParams.Gender != "" {
-		cache.AddConditionCache(c, "gender", key)
+	return kept
+}
+
+type searchResult struct {
+	items []utils.Item
+	// budgets of the budgeted banners among the candidates
+	budgets map[uint]cache.Budget
+}
+
+// weighted results are drawn anew for every request, caching would freeze the order.
+// results with budgeted banners depend on their pace and have to spend on every serve
+func (r searchResult) cacheable(publicParams utils.PublicParams) bool {
+	return publicParams.Rank != models.RankWeighted && len(r.budgets) == 0
+}
+
+// drops the budgeted banners that are ahead of their pace, collecting the budgets of the candidates into budgets
+func budgetFilter(ctx context.Context, budgets map[uint]cache.Budget) models.BannerFilter {
+	return func(banners []models.Banner) ([]models.Banner, error) {
+		list := []cache.Budget{}
+		for _, b := range banners {
+			budget := cache.Budget{BannerID: b.ID, Daily: b.DailyBudget, Lifetime: b.LifetimeBudget, StartAt: b.StartAt, EndAt: b.EndAt}
+			if budget.IsLimited() {
+				budgets[b.ID] = budget
+				list = append(list, budget)
+			}
+		}
+
+		throttled, err := cache.ThrottledBanners(ctx, list)
+		if err != nil {
+			// without the counters the pace is unknown, hold back the budgeted banners instead of overspending
+			fmt.Println(err)
+			throttled = map[uint]bool{}
+			for id := range budgets {
+				throttled[id] = true
+			}
+		}
+
+		filtered := []models.Banner{}
+		for _, b := range banners {
+			if !throttled[b.ID] {
+				filtered = append(filtered, b)
+			}
+		}
+		return filtered, nil
 	}
-	if publicParams.Platform != "" {
-		cache.AddConditionCache(c, "platform", key)
+}
+
+// spends the budget of every served budgeted banner, dropping the ones that ran out since they were filtered
+func spendBudgets(c *gin.Context, result searchResult) []utils.Item {
+	if len(result.budgets) == 0 {
+		return result.items
 	}
 
-	c.JSON(http.StatusOK, item)
+	var item []utils.Item
+	for _, i := range result.items {
+		budget, ok := result.budgets[i.ID]
+		if !ok {
+			item = append(item, i)
+			continue
+		}
+
+		spent, err := cache.SpendBudget(c, budget)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if spent {
+			item = append(item, i)
+		}
+	}
+	return item
 }
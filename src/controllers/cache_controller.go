@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"main/cache"
+	"main/utils"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// path of the public search, the prefix of every cached key
+const searchPath = "/api/v1/ad"
+
+// hit and miss counters of the response cache, and whether redis is currently bypassed
+func GetCacheMetrics(c *gin.Context) {
+	c.JSON(http.StatusOK, cache.Metrics())
+}
+
+// moves the matching queries to new keys at once instead of deleting them one by one
+func InvalidateCache(c *gin.Context) {
+	var invalidateParams utils.InvalidateParams
+	if err := c.ShouldBindQuery(&invalidateParams); err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	// the body may carry them as JSON too, a body that is not JSON must not turn into a global invalidation
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&invalidateParams); err != nil && !errors.Is(err, io.EOF) {
+			fmt.Println(err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	if invalidateParams.Dimension != "" && !cache.IsValidDimension(invalidateParams.Dimension) ||
+		invalidateParams.Dimension == "" && invalidateParams.Value != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dimension"})
+		return
+	}
+
+	generation, err := cache.BumpGeneration(c, invalidateParams.Dimension, invalidateParams.Value)
+	if err != nil {
+		fmt.Println(err)
+		// when only the publish failed the bump went through, the other instances reload it shortly
+		if generation == 0 {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Cache invalidated", "generation": generation})
+}
+
+func WarmCache(c *gin.Context) {
+	warmed, err := WarmCacheQueries(c)
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Cache warmed", "warmed": warmed})
+}
+
+// queries warmed besides the popular ones, the single conditions of the load test by default.
+// configured by CACHE_WARM_QUERIES as comma separated query strings, e.g. country=TW,gender=F&platform=ios
+func warmQueries() []string {
+	if raw := os.Getenv("CACHE_WARM_QUERIES"); raw != "" {
+		return strings.Split(raw, ",")
+	}
+
+	queries := []string{}
+	for _, gender := range []string{"M", "F"} {
+		queries = append(queries, "gender="+gender)
+	}
+	for _, country := range []string{"TW", "US", "JP", "KR", "CN", "HK", "CA", "UK", "FR", "DE", "IT"} {
+		queries = append(queries, "country="+country)
+	}
+	for _, platform := range []string{"ios", "android", "web"} {
+		queries = append(queries, "platform="+platform)
+	}
+	return queries
+}
+
+// number of popular queries warmed, configured by CACHE_WARM_TOP (default 100)
+func warmTop() int {
+	if n, err := strconv.Atoi(os.Getenv("CACHE_WARM_TOP")); err == nil && n >= 0 {
+		return n
+	}
+	return 100
+}
+
+// caches the unfiltered query, the configured ones and the most missed ones of the last two days
+// that are not cached yet, returning how many were cached
+func WarmCacheQueries(ctx context.Context) (int, error) {
+	queries := append([]string{""}, warmQueries()...)
+
+	if n := warmTop(); n > 0 {
+		keys, err := cache.PopularQueries(ctx, n)
+		if err != nil {
+			return 0, err
+		}
+		for _, k := range keys {
+			if u, err := url.Parse(k); err == nil {
+				queries = append(queries, u.RawQuery)
+			}
+		}
+	}
+
+	warmed := 0
+	seen := map[string]bool{}
+	for _, q := range queries {
+		publicParams, err := parsePublicQuery(q)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		key := cache.VersionedKey(publicParams.CacheKey(searchPath), publicParams)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if cached, err := cache.IsCached(ctx, key); err != nil {
+			return warmed, err
+		} else if cached {
+			continue
+		}
+
+		result, err := searchAndCache(ctx, key, publicParams)
+		if err != nil {
+			return warmed, err
+		}
+		if result.cacheable(publicParams) {
+			warmed++
+		}
+	}
+	return warmed, nil
+}
+
+// the cacheable public query of a query string, validated with its defaults applied
+func parsePublicQuery(query string) (utils.PublicParams, error) {
+	var publicParams utils.PublicParams
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return publicParams, err
+	}
+
+	if err := binding.MapFormWithTag(&publicParams, values, "form"); err != nil {
+		return publicParams, err
+	}
+
+	if msg := validatePublicParams(&publicParams); msg != "" {
+		return publicParams, fmt.Errorf("%s: %s", msg, query)
+	}
+	if publicParams.UserID != "" {
+		return publicParams, errors.New("queries of a user are not cached: " + query)
+	}
+	return publicParams, nil
+}
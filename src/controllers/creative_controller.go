@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"main/models"
+	"main/utils"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+func validateCreativeParams(creativeParams *utils.CreativeParams) error {
+	if !isValidURL(creativeParams.ImageURL) || !isValidURL(creativeParams.LinkURL) {
+		return errors.New("Valid imageUrl and linkUrl are required")
+	}
+
+	if creativeParams.Width < 0 || creativeParams.Height < 0 {
+		return errors.New("Invalid dimensions")
+	}
+
+	if creativeParams.Weight < 0 {
+		return errors.New("Invalid weight")
+	}
+
+	if creativeParams.Weight == 0 {
+		creativeParams.Weight = 1
+	}
+
+	return nil
+}
+
+func isValidURL(raw string) bool {
+	u, err := url.ParseRequestURI(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func parseCreativeID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("creativeId"), 10, 64)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid creative id"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// creatives are part of the cached responses, so every change evicts the banner's cached results
+func deleteBannerCache(c *gin.Context, bannerID uint) {
+	banner, err := Store.GetBanner(bannerID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	deleteRelatedCache(c, banner.Detail().Conditions)
+}
+
+func respondCreativeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrBannerNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Banner not found"})
+	case errors.Is(err, models.ErrCreativeNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Creative not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+func ListCreatives(c *gin.Context) {
+	bannerID, ok := parseBannerID(c)
+	if !ok {
+		return
+	}
+
+	creatives, err := Store.ListCreatives(bannerID)
+	if err != nil {
+		respondCreativeError(c, err)
+		return
+	}
+
+	details := []utils.CreativeDetail{}
+	for _, cr := range creatives {
+		details = append(details, cr.Detail())
+	}
+
+	c.JSON(http.StatusOK, details)
+}
+
+func CreateCreative(c *gin.Context) {
+	bannerID, ok := parseBannerID(c)
+	if !ok {
+		return
+	}
+
+	var creativeParams utils.CreativeParams
+	if err := c.ShouldBind(&creativeParams); err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if err := validateCreativeParams(&creativeParams); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := Store.CreateCreative(bannerID, creativeParams)
+	if err != nil {
+		respondCreativeError(c, err)
+		return
+	}
+
+	deleteBannerCache(c, bannerID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Creative created", "id": id})
+}
+
+func UpdateCreative(c *gin.Context) {
+	bannerID, ok := parseBannerID(c)
+	if !ok {
+		return
+	}
+
+	id, ok := parseCreativeID(c)
+	if !ok {
+		return
+	}
+
+	var creativeParams utils.CreativeParams
+	if err := c.ShouldBind(&creativeParams); err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if err := validateCreativeParams(&creativeParams); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := Store.UpdateCreative(bannerID, id, creativeParams); err != nil {
+		respondCreativeError(c, err)
+		return
+	}
+
+	deleteBannerCache(c, bannerID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Creative updated"})
+}
+
+func DeleteCreative(c *gin.Context) {
+	bannerID, ok := parseBannerID(c)
+	if !ok {
+		return
+	}
+
+	id, ok := parseCreativeID(c)
+	if !ok {
+		return
+	}
+
+	if err := Store.DeleteCreative(bannerID, id); err != nil {
+		respondCreativeError(c, err)
+		return
+	}
+
+	deleteBannerCache(c, bannerID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Creative deleted"})
+}
@@ -0,0 +1,219 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"main/cache"
+	"main/models"
+	"main/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+func parseExperimentID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func respondExperimentError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrBannerNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Banner not found"})
+	case errors.Is(err, models.ErrCreativeNotFound):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Creative does not belong to the banner"})
+	case errors.Is(err, models.ErrExperimentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Experiment not found"})
+	case errors.Is(err, models.ErrVariantNotFound):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Variant does not belong to the experiment"})
+	case errors.Is(err, models.ErrExperimentRunning):
+		c.JSON(http.StatusConflict, gin.H{"error": "Banner already has a running experiment"})
+	case errors.Is(err, models.ErrExperimentEnded):
+		c.JSON(http.StatusConflict, gin.H{"error": "Experiment is not running"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// fills in the exposures, clicks and CTR of every variant, live from redis while the experiment runs
+func experimentDetail(c *gin.Context, experiment models.Experiment) (utils.ExperimentDetail, error) {
+	detail := experiment.Detail()
+
+	if experiment.Status == models.ExperimentRunning {
+		ids := []uint{}
+		for _, v := range detail.Variants {
+			ids = append(ids, v.ID)
+		}
+
+		exposures, clicks, err := cache.VariantCounts(c, ids)
+		if err != nil {
+			return detail, err
+		}
+
+		for i := range detail.Variants {
+			detail.Variants[i].Exposures = exposures[detail.Variants[i].ID]
+			detail.Variants[i].Clicks = clicks[detail.Variants[i].ID]
+		}
+	}
+
+	for i, v := range detail.Variants {
+		if v.Exposures != 0 {
+			detail.Variants[i].CTR = float64(v.Clicks) / float64(v.Exposures)
+		}
+	}
+	return detail, nil
+}
+
+func CreateExperiment(c *gin.Context) {
+	var experimentParams utils.ExperimentParams
+	if err := c.ShouldBind(&experimentParams); err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if experimentParams.BannerID == 0 || len(experimentParams.Variants) < 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bannerId and at least two variants are required"})
+		return
+	}
+
+	for i, v := range experimentParams.Variants {
+		if v.Name == "" || v.Weight < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid variant"})
+			return
+		}
+		if v.Weight == 0 {
+			experimentParams.Variants[i].Weight = 1
+		}
+	}
+
+	id, err := Store.CreateExperiment(experimentParams)
+	if err != nil {
+		respondExperimentError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Experiment created", "id": id})
+}
+
+func GetExperiment(c *gin.Context) {
+	id, ok := parseExperimentID(c)
+	if !ok {
+		return
+	}
+
+	experiment, err := Store.GetExperiment(id)
+	if err != nil {
+		respondExperimentError(c, err)
+		return
+	}
+
+	detail, err := experimentDetail(c, experiment)
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, detail)
+}
+
+func PromoteVariant(c *gin.Context) {
+	id, ok := parseExperimentID(c)
+	if !ok {
+		return
+	}
+
+	var promoteParams utils.PromoteParams
+	if err := c.ShouldBind(&promoteParams); err != nil || promoteParams.VariantID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	experiment, err := Store.GetExperiment(id)
+	if err != nil {
+		respondExperimentError(c, err)
+		return
+	}
+
+	ids := []uint{}
+	for _, v := range experiment.Variants {
+		ids = append(ids, v.ID)
+	}
+
+	exposures, clicks, err := cache.VariantCounts(c, ids)
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	experiment, err = Store.PromoteVariant(actor(c), id, promoteParams.VariantID, exposures, clicks)
+	if err != nil {
+		respondExperimentError(c, err)
+		return
+	}
+
+	// the banner's title or creatives changed
+	deleteBannerCache(c, experiment.BannerID)
+
+	detail, _ := experimentDetail(c, experiment)
+	c.JSON(http.StatusOK, detail)
+}
+
+// swaps in the title and creative of the variant each item's running experiment assigns the user to,
+// recording the exposures. items are copied since the creative candidates may be shared
+func applyExperiments(c *gin.Context, userID string, items []utils.Item) []utils.Item {
+	ids := []uint{}
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+
+	experiments, err := Store.RunningExperiments(ids)
+	if err != nil {
+		fmt.Println(err)
+		return items
+	}
+	if len(experiments) == 0 {
+		return items
+	}
+
+	exposed := []uint{}
+	applied := make([]utils.Item, len(items))
+	for i, item := range items {
+		applied[i] = item
+
+		experiment, ok := experiments[item.ID]
+		if !ok {
+			continue
+		}
+
+		variant := experiment.Assign(userID)
+		if variant == nil {
+			continue
+		}
+
+		applied[i].VariantID = variant.ID
+		if variant.Title != "" {
+			applied[i].Title = variant.Title
+		}
+		if variant.CreativeID != 0 {
+			for _, cr := range item.Creatives {
+				if cr.ID == variant.CreativeID {
+					applied[i].Creatives = []utils.CreativeItem{cr}
+				}
+			}
+		}
+		exposed = append(exposed, variant.ID)
+	}
+
+	if err := cache.RecordExposures(c, exposed); err != nil {
+		fmt.Println(err)
+	}
+	return applied
+}
@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"errors"
+	"main/models"
+	"main/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// who made the request, recorded with every change of a banner
+func actor(c *gin.Context) string {
+	if a := c.GetHeader("X-Actor"); a != "" {
+		return a
+	}
+	return "anonymous"
+}
+
+func parseRevisionID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("revisionId"), 10, 64)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid revision id"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// every change of the banner, oldest first. the history stays after the banner is deleted
+func BannerHistory(c *gin.Context) {
+	id, ok := parseBannerID(c)
+	if !ok {
+		return
+	}
+
+	revisions, err := Store.BannerHistory(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	if len(revisions) == 0 {
+		// banners created before the history was kept have none
+		_, err := Store.GetBanner(id)
+		if errors.Is(err, models.ErrBannerNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Banner not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+	}
+
+	list := utils.RevisionList{Data: []utils.RevisionDetail{}}
+	for _, r := range revisions {
+		list.Data = append(list.Data, r.Detail())
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// puts the banner back to how a revision left it, as a new revision. the status goes
+// through the status endpoint and a deleted banner cannot be restored
+func RestoreBanner(c *gin.Context) {
+	id, ok := parseBannerID(c)
+	if !ok {
+		return
+	}
+	revisionID, ok := parseRevisionID(c)
+	if !ok {
+		return
+	}
+
+	revision, err := Store.RestoreBanner(actor(c), id, revisionID)
+	if errors.Is(err, models.ErrBannerNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Banner not found"})
+		return
+	}
+	if errors.Is(err, models.ErrRevisionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Revision not found"})
+		return
+	}
+	if errors.Is(err, models.ErrNothingToRestore) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Revision has no banner to restore"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	detail := revision.Detail()
+	deleteRelatedCache(c, detail.Before.Conditions, detail.After.Conditions)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Banner restored", "revision": detail})
+}
@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"fmt"
+	"main/cache"
+	"main/models"
+	"main/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TrackImpression(c *gin.Context) {
+	trackEvent(c, cache.EventImpression)
+}
+
+// a click on a banner served as part of an experiment carries the variantId it was served with,
+// which has to be a variant of the banner's running experiment
+func TrackClick(c *gin.Context) {
+	id, ok := parseBannerID(c)
+	if !ok {
+		return
+	}
+
+	if raw := c.Query("variantId"); raw != "" {
+		variantID, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid variantId"})
+			return
+		}
+
+		experiments, err := Store.RunningExperiments([]uint{id})
+		if err != nil {
+			fmt.Println(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		if !hasVariant(experiments[id], uint(variantID)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid variantId"})
+			return
+		}
+
+		if err := cache.RecordVariantClick(c, uint(variantID)); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	trackEvent(c, cache.EventClick)
+}
+
+func hasVariant(experiment models.Experiment, variantID uint) bool {
+	for _, v := range experiment.Variants {
+		if v.ID == variantID {
+			return true
+		}
+	}
+	return false
+}
+
+// events are only buffered in redis here, the stats flusher job writes them to the database
+func trackEvent(c *gin.Context, event string) {
+	id, ok := parseBannerID(c)
+	if !ok {
+		return
+	}
+
+	if err := cache.RecordEvent(c, id, event); err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func Report(c *gin.Context) {
+	var reportParams utils.ReportParams
+	if err := c.ShouldBind(&reportParams); err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if !reportParams.From.IsZero() && !reportParams.To.IsZero() && reportParams.From.After(reportParams.To) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "From must be before to"})
+		return
+	}
+
+	items, err := Store.Report(reportParams)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
+}
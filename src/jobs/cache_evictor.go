@@ -0,0 +1,70 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"main/cache"
+	"main/models"
+	"main/utils"
+	"time"
+)
+
+// longest the evictor sleeps, so banners created in the meantime are picked up
+const evictorMaxWait = time.Minute
+
+// evicts the cached responses of banners as soon as they start or end,
+// instead of waiting for their ttl to run out
+func StartCacheEvictor(store models.BannerStore) {
+	go func() {
+		last := time.Now()
+		for {
+			time.Sleep(nextEviction(store, last))
+
+			now := time.Now()
+			if err := EvictCrossedBanners(context.Background(), store, last, now); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			last = now
+		}
+	}()
+}
+
+// time until the next banner starts or ends, capped at evictorMaxWait
+func nextEviction(store models.BannerStore, now time.Time) time.Duration {
+	boundary, ok, err := store.NextBannerBoundary(utils.PublicParams{}, now)
+	if err != nil {
+		fmt.Println(err)
+		return evictorMaxWait
+	}
+
+	if d := time.Until(boundary); ok && d < evictorMaxWait {
+		if d < 0 {
+			return 0
+		}
+		return d + time.Second
+	}
+	return evictorMaxWait
+}
+
+// deletes the cached responses every banner that started or ended in (from, to] can appear in
+func EvictCrossedBanners(ctx context.Context, store models.BannerStore, from, to time.Time) error {
+	banners, err := store.CrossedBanners(from, to)
+	if err != nil || len(banners) == 0 {
+		return err
+	}
+
+	conditions := []utils.ConditionParams{}
+	for _, b := range banners {
+		conditions = append(conditions, b.Conditions())
+	}
+
+	return cache.DeleteMatchingCache(ctx, func(p utils.PublicParams) bool {
+		for _, cond := range conditions {
+			if cond.Matches(p) {
+				return true
+			}
+		}
+		return false
+	})
+}
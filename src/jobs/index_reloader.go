@@ -0,0 +1,32 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"main/cache"
+	"main/models"
+	"time"
+)
+
+// keeps the banner index in step with the other instances: the banners they write are
+// refreshed as soon as they publish them, and the whole index is rebuilt every
+// models.IndexReloadInterval in case a message was missed. needs cache.Init first
+func StartIndexReloader(index *models.IndexedStore) {
+	publish := cache.WatchBannerChanges(index.Refresh)
+	index.Notify = func(id uint) {
+		if err := publish(context.Background(), id); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(models.IndexReloadInterval())
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := index.Load(); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,88 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"main/cache"
+	"main/models"
+	"os"
+	"strconv"
+	"time"
+)
+
+// periodically moves the impression and click counters buffered in redis into the database,
+// every STATS_FLUSH_INTERVAL seconds (default 60)
+func StartStatsFlusher(store models.BannerStore) {
+	interval := 60 * time.Second
+	if seconds, err := strconv.Atoi(os.Getenv("STATS_FLUSH_INTERVAL")); err == nil && seconds > 0 {
+		interval = time.Duration(seconds) * time.Second
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := FlushStats(context.Background(), store); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}()
+}
+
+func FlushStats(ctx context.Context, store models.BannerStore) error {
+	token, ok, err := cache.LockStats(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// another replica is flushing, its batch must not be read twice
+		return nil
+	}
+	defer func() {
+		if err := cache.UnlockStats(ctx, token); err != nil {
+			fmt.Println(err)
+		}
+	}()
+
+	counts, err := cache.PopStats(ctx)
+	if err != nil {
+		return err
+	}
+
+	type statKey struct {
+		bannerID uint
+		day      time.Time
+	}
+
+	merged := map[statKey]*models.BannerStat{}
+	stats := []*models.BannerStat{}
+	for _, c := range counts {
+		key := statKey{c.BannerID, c.Day}
+		s, ok := merged[key]
+		if !ok {
+			s = &models.BannerStat{BannerID: c.BannerID, Day: c.Day}
+			merged[key] = s
+			stats = append(stats, s)
+		}
+
+		switch c.Event {
+		case cache.EventImpression:
+			s.Impressions += c.Count
+		case cache.EventClick:
+			s.Clicks += c.Count
+		}
+	}
+
+	rows := []models.BannerStat{}
+	for _, s := range stats {
+		rows = append(rows, *s)
+	}
+
+	// keep the batch in redis if the database write fails so the next tick retries it
+	if err := store.AddStats(rows); err != nil {
+		return err
+	}
+
+	return cache.AckStats(ctx)
+}
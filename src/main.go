@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"main/cache"
+	"main/controllers"
+	"main/jobs"
 	"main/models"
 	"main/routers"
 	"main/tests/load_test"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -23,14 +28,26 @@ func main() {
 			os.Setenv("APP_ENV", "test")
 			models.Init()
 			cache.Init()
-			router := routers.Init()
 
 			load_test.DeleteAllData()
 			load_test.InsertLoadTestData()
 			fmt.Println("Load test data inserted")
 
+			store := indexBanners(models.NewGormStore(models.DB))
+			jobs.StartStatsFlusher(store)
+			jobs.StartCacheEvictor(store)
+			router := routers.Init(store)
+			warmCache()
+
 			port := os.Getenv("TEST_PORT")
 			router.Run(":" + port)
+		} else if os.Args[1] == "migrate" {
+			err := godotenv.Load()
+			if err != nil {
+				panic(err)
+			}
+
+			migrate(os.Args[2:])
 		}
 	} else {
 		err := godotenv.Load()
@@ -38,12 +55,107 @@ func main() {
 			panic(err)
 		}
 
-		router := routers.Init()
-		models.Init()
 		cache.Init()
 
+		var store models.BannerStore
+		if os.Getenv("BANNER_STORE") == "memory" {
+			// runs without postgres, nothing is kept across restarts
+			store = models.NewMemoryStore()
+		} else {
+			models.Init()
+			store = indexBanners(models.NewGormStore(models.DB))
+		}
+
+		router := routers.Init(store)
+		jobs.StartStatsFlusher(store)
+		jobs.StartCacheEvictor(store)
+		warmCache()
+
 		port := os.Getenv("APP_PORT")
 		router.Run(":" + port)
 	}
 
 }
+
+// runs `migrate up`, `migrate down [steps]` or `migrate status` against the database of .env
+func migrate(args []string) {
+	os.Setenv("DB_MIGRATE_ON_START", "false")
+	models.Init()
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		applied, err := models.MigrateUp(models.DB)
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("%d migrations applied\n", len(applied))
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				panic(err)
+			}
+			steps = n
+		}
+
+		reverted, err := models.MigrateDown(models.DB, steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("%d migrations reverted\n", len(reverted))
+	case "status":
+		states, err := models.MigrationStatus(models.DB)
+		if err != nil {
+			panic(err)
+		}
+		for _, s := range states {
+			if s.AppliedAt == nil {
+				fmt.Printf("%04d_%s pending\n", s.Version, s.Name)
+			} else {
+				fmt.Printf("%04d_%s applied at %s\n", s.Version, s.Name, s.AppliedAt.Format(time.RFC3339))
+			}
+		}
+	default:
+		fmt.Println("usage: main migrate [up | down [steps] | status]")
+		os.Exit(2)
+	}
+}
+
+// serves the public search from an in-memory index of the banners when BANNER_INDEX is true
+func indexBanners(store models.BannerStore) models.BannerStore {
+	if os.Getenv("BANNER_INDEX") != "true" {
+		return store
+	}
+
+	index := models.NewIndexedStore(store)
+	if err := index.Load(); err != nil {
+		panic(err)
+	}
+	jobs.StartIndexReloader(index)
+	return index
+}
+
+// fills the cache before the first requests arrive, unless CACHE_WARM_ON_START is false
+func warmCache() {
+	if os.Getenv("CACHE_WARM_ON_START") == "false" {
+		return
+	}
+
+	warmed, err := controllers.WarmCacheQueries(context.Background())
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Printf("%d queries warmed\n", warmed)
+}
@@ -1,22 +1,94 @@
 package models
 
 import (
+	"errors"
 	"main/utils"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+var (
+	ErrBannerNotFound    = errors.New("banner not found")
+	ErrInvalidTransition = errors.New("invalid status transition")
+)
+
+// lifecycle states of a banner, only scheduled and active banners are served
+const (
+	StatusDraft     = "draft"
+	StatusScheduled = "scheduled"
+	StatusActive    = "active"
+	StatusPaused    = "paused"
+	StatusStopped   = "stopped"
+	StatusArchived  = "archived"
+)
+
+// key: current status, value: statuses it may move to
+var statusTransitions = map[string][]string{
+	StatusDraft:     {StatusScheduled, StatusActive, StatusArchived},
+	StatusScheduled: {StatusDraft, StatusActive, StatusPaused, StatusStopped, StatusArchived},
+	StatusActive:    {StatusPaused, StatusStopped},
+	StatusPaused:    {StatusActive, StatusStopped},
+	StatusStopped:   {StatusArchived},
+	StatusArchived:  {},
+}
+
+var servingStatuses = []string{StatusScheduled, StatusActive}
+
+func IsValidStatus(status string) bool {
+	_, ok := statusTransitions[status]
+	return ok
+}
+
+func CanTransition(from, to string) bool {
+	for _, s := range statusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
 type Banner struct {
-	ID        uint
-	Title     string
-	StartAt   time.Time
-	EndAt     time.Time
-	AgeStart  int
-	AgeEnd    int
-	Genders   []Gender   `gorm:"many2many:banner_gender;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	Countries []Country  `gorm:"many2many:banner_country;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	Platforms []Platform `gorm:"many2many:banner_platform;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	ID       uint
+	Title    string
+	Status   string `gorm:"default:active;index"`
+	Priority int
+	Weight   int `gorm:"default:1"`
+	// max impressions per user, 0 means no cap
+	CapHourly   int
+	CapDaily    int
+	CapLifetime int
+	// impression budgets, 0 means unlimited
+	DailyBudget    int64
+	LifetimeBudget int64
+	StartAt        time.Time
+	EndAt          time.Time
+	AgeStart       int
+	AgeEnd         int
+	Genders        []Gender   `gorm:"many2many:banner_gender;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Countries      []Country  `gorm:"many2many:banner_country;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Platforms      []Platform `gorm:"many2many:banner_platform;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	// the banner is never shown to these, whatever the conditions above say
+	ExcludedGenders   []Gender         `gorm:"many2many:banner_excluded_gender;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	ExcludedCountries []Country        `gorm:"many2many:banner_excluded_country;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	ExcludedPlatforms []Platform       `gorm:"many2many:banner_excluded_platform;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Schedules         []BannerSchedule `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	CreativeRotation  string           `gorm:"default:even"`
+	Creatives         []Creative       `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// associations holding the targeting conditions of a banner
+var conditionAssociations = []string{"Genders", "Countries", "Platforms", "ExcludedGenders", "ExcludedCountries", "ExcludedPlatforms"}
+
+func withConditions(tx *gorm.DB) *gorm.DB {
+	for _, a := range conditionAssociations {
+		tx = tx.Preload(a)
+	}
+	return tx.Preload("Schedules").Preload("Creatives", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id asc")
+	})
 }
 
 type Gender struct {
@@ -61,40 +133,325 @@ func (p *Platform) BeforeCreate(tx *gorm.DB) (err error) {
 	return nil
 }
 
-func CreateBanner(p utils.AdminParams) error {
+func toGenders(names []string) []Gender {
 	var genders []Gender
-	var countries []Country
-	var platforms []Platform
-
-	for _, g := range p.Conditions.Gender {
+	for _, g := range names {
 		genders = append(genders, Gender{Name: g})
 	}
+	return genders
+}
 
-	for _, c := range p.Conditions.Country {
+func toCountries(names []string) []Country {
+	var countries []Country
+	for _, c := range names {
 		countries = append(countries, Country{Name: c})
 	}
+	return countries
+}
 
-	for _, p := range p.Conditions.Platform {
+func toPlatforms(names []string) []Platform {
+	var platforms []Platform
+	for _, p := range names {
 		platforms = append(platforms, Platform{Name: p})
 	}
+	return platforms
+}
+
+func genderNames(genders []Gender) []string {
+	names := []string{}
+	for _, g := range genders {
+		names = append(names, g.Name)
+	}
+	return names
+}
+
+func countryNames(countries []Country) []string {
+	names := []string{}
+	for _, c := range countries {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func platformNames(platforms []Platform) []string {
+	names := []string{}
+	for _, p := range platforms {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+func buildBanner(p utils.AdminParams) Banner {
+	return Banner{
+		Title:             p.Title,
+		Status:            p.Status,
+		Priority:          p.Priority,
+		Weight:            p.Weight,
+		CapHourly:         p.FrequencyCap.Hour,
+		CapDaily:          p.FrequencyCap.Day,
+		CapLifetime:       p.FrequencyCap.Lifetime,
+		DailyBudget:       p.Budget.Daily,
+		LifetimeBudget:    p.Budget.Lifetime,
+		StartAt:           p.StartAt,
+		EndAt:             p.EndAt,
+		AgeStart:          p.Conditions.AgeStart,
+		AgeEnd:            p.Conditions.AgeEnd,
+		Genders:           toGenders(p.Conditions.Gender),
+		Countries:         toCountries(p.Conditions.Country),
+		Platforms:         toPlatforms(p.Conditions.Platform),
+		ExcludedGenders:   toGenders(p.Conditions.ExcludeGender),
+		ExcludedCountries: toCountries(p.Conditions.ExcludeCountry),
+		ExcludedPlatforms: toPlatforms(p.Conditions.ExcludePlatform),
+		Schedules:         toSchedules(p.Schedules),
+		CreativeRotation:  p.CreativeRotation,
+	}
+}
+
+func (b *Banner) Detail() utils.BannerDetail {
+	creatives := []utils.CreativeDetail{}
+	for _, c := range b.Creatives {
+		creatives = append(creatives, c.Detail())
+	}
+
+	return utils.BannerDetail{
+		ID:        b.ID,
+		Creatives: creatives,
+		AdminParams: utils.AdminParams{
+			Title:            b.Title,
+			Status:           b.Status,
+			CreativeRotation: b.CreativeRotation,
+			Priority:         b.Priority,
+			Weight:           b.Weight,
+			FrequencyCap: utils.FrequencyCapParams{
+				Hour:     b.CapHourly,
+				Day:      b.CapDaily,
+				Lifetime: b.CapLifetime,
+			},
+			Budget: utils.BudgetParams{
+				Daily:    b.DailyBudget,
+				Lifetime: b.LifetimeBudget,
+			},
+			StartAt:    b.StartAt,
+			EndAt:      b.EndAt,
+			Schedules:  scheduleParams(b.Schedules),
+			Conditions: b.Conditions(),
+		},
+	}
+}
+
+// the targeting of the banner, in the shape the api and the cache matching use
+func (b *Banner) Conditions() utils.ConditionParams {
+	return utils.ConditionParams{
+		AgeStart:        b.AgeStart,
+		AgeEnd:          b.AgeEnd,
+		Gender:          genderNames(b.Genders),
+		Country:         countryNames(b.Countries),
+		Platform:        platformNames(b.Platforms),
+		ExcludeGender:   genderNames(b.ExcludedGenders),
+		ExcludeCountry:  countryNames(b.ExcludedCountries),
+		ExcludePlatform: platformNames(b.ExcludedPlatforms),
+	}
+}
 
-	banner := Banner{
-		Title:     p.Title,
-		StartAt:   p.StartAt,
-		EndAt:     p.EndAt,
-		AgeStart:  p.Conditions.AgeStart,
-		AgeEnd:    p.Conditions.AgeEnd,
-		Genders:   genders,
-		Countries: countries,
-		Platforms: platforms,
+func (s *GormStore) CreateBanner(actor string, p utils.AdminParams) (uint, error) {
+	banner := buildBanner(p)
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&banner).Error; err != nil {
+			return err
+		}
+		created, err := getBanner(tx, banner.ID)
+		if err != nil {
+			return err
+		}
+		return tx.Create(newRevision(actor, RevisionCreate, banner.ID, nil, &created)).Error
+	})
+	if err != nil {
+		return 0, err
 	}
+	return banner.ID, nil
+}
 
-	return DB.Create(&banner).Error
+func getBanner(tx *gorm.DB, id uint) (Banner, error) {
+	var banner Banner
+	err := withConditions(tx).First(&banner, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return banner, ErrBannerNotFound
+	}
+	return banner, err
+}
+
+func (s *GormStore) GetBanner(id uint) (Banner, error) {
+	return getBanner(s.db, id)
 }
 
-func SearchBanner(p utils.PublicParams) ([]utils.Item, error) {
+func (s *GormStore) ListBanners(p utils.ListParams) ([]Banner, int64, error) {
 	var banners []Banner
-	query := "NOW() BETWEEN start_at AND end_at"
+	var total int64
+
+	tx := s.db.Model(&Banner{})
+	if p.Status != "" {
+		tx = tx.Where("status = ?", p.Status)
+	}
+
+	if err := tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	err := withConditions(tx).
+		Order("id asc").Offset(p.Offset).Limit(p.Limit).Find(&banners).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return banners, total, nil
+}
+
+// replaces the banner's fields and all of its conditions
+func (s *GormStore) UpdateBanner(actor string, id uint, p utils.AdminParams) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		_, err := replaceBanner(tx, newRevision(actor, RevisionUpdate, id, nil, nil), p)
+		return err
+	})
+}
+
+// replaces the banner of the revision with p and records the revision with the banner before and after
+func replaceBanner(tx *gorm.DB, revision *BannerRevision, p utils.AdminParams) (BannerRevision, error) {
+	id := revision.BannerID
+	before, err := getBanner(tx, id)
+	if err != nil {
+		return BannerRevision{}, err
+	}
+
+	banner := buildBanner(p)
+	banner.ID = id
+
+	res := tx.Model(&Banner{ID: id}).Select("title", "creative_rotation", "priority", "weight", "cap_hourly", "cap_daily", "cap_lifetime", "daily_budget", "lifetime_budget", "start_at", "end_at", "age_start", "age_end").Updates(&banner)
+	if res.Error != nil {
+		return BannerRevision{}, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return BannerRevision{}, ErrBannerNotFound
+	}
+
+	conditions := map[string]interface{}{
+		"Genders":           banner.Genders,
+		"Countries":         banner.Countries,
+		"Platforms":         banner.Platforms,
+		"ExcludedGenders":   banner.ExcludedGenders,
+		"ExcludedCountries": banner.ExcludedCountries,
+		"ExcludedPlatforms": banner.ExcludedPlatforms,
+	}
+	for _, a := range conditionAssociations {
+		if err := tx.Model(&banner).Association(a).Replace(conditions[a]); err != nil {
+			return BannerRevision{}, err
+		}
+	}
+
+	// replacing a has-many association only detaches the old rows, delete them instead
+	if err := tx.Where("banner_id = ?", id).Delete(&BannerSchedule{}).Error; err != nil {
+		return BannerRevision{}, err
+	}
+	for i := range banner.Schedules {
+		banner.Schedules[i].BannerID = id
+	}
+	if len(banner.Schedules) != 0 {
+		if err := tx.Create(&banner.Schedules).Error; err != nil {
+			return BannerRevision{}, err
+		}
+	}
+
+	after, err := getBanner(tx, id)
+	if err != nil {
+		return BannerRevision{}, err
+	}
+	revision.Before, revision.After = snapshot(&before), snapshot(&after)
+	err = tx.Create(revision).Error
+	return *revision, err
+}
+
+// moves the banner to the given status, failing if the move is not allowed from its current one
+func (s *GormStore) TransitionBanner(actor string, id uint, to string) (Banner, error) {
+	var banner Banner
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if banner, err = getBanner(tx, id); err != nil {
+			return err
+		}
+
+		if !CanTransition(banner.Status, to) {
+			return ErrInvalidTransition
+		}
+
+		// guard against a concurrent transition by matching the status we validated against
+		res := tx.Model(&Banner{}).Where("id = ? AND status = ?", id, banner.Status).Update("status", to)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInvalidTransition
+		}
+
+		after := banner.clone()
+		after.Status = to
+		return tx.Create(newRevision(actor, RevisionStatus, id, &banner, &after)).Error
+	})
+	return banner, err
+}
+
+func (s *GormStore) DeleteBanner(actor string, id uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		banner, err := getBanner(tx, id)
+		if err != nil {
+			return err
+		}
+
+		res := tx.Select(clause.Associations).Delete(&Banner{ID: id})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrBannerNotFound
+		}
+		return tx.Create(newRevision(actor, RevisionDelete, id, &banner, nil)).Error
+	})
+}
+
+// every revision of the banner, oldest first
+func (s *GormStore) BannerHistory(id uint) ([]BannerRevision, error) {
+	var revisions []BannerRevision
+	err := s.db.Where("banner_id = ?", id).Order("id asc").Find(&revisions).Error
+	return revisions, err
+}
+
+// puts the banner back to how the revision left it, the status and creatives are kept
+func (s *GormStore) RestoreBanner(actor string, id, revisionID uint) (BannerRevision, error) {
+	var restored BannerRevision
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var revision BannerRevision
+		err := tx.Where("id = ? AND banner_id = ?", revisionID, id).First(&revision).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrRevisionNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		p, err := revision.State()
+		if err != nil {
+			return err
+		}
+
+		restore := newRevision(actor, RevisionRestore, id, nil, nil)
+		restore.RestoredFrom = revision.ID
+		restored, err = replaceBanner(tx, restore, p)
+		return err
+	})
+	return restored, err
+}
+
+// the targeting part of the search, to be used with joinConditions
+func targetingQuery(p utils.PublicParams) (string, []interface{}) {
+	query := ""
 	queryParams := []interface{}{}
 
 	if p.Age != 0 {
@@ -104,38 +461,132 @@ func SearchBanner(p utils.PublicParams) ([]utils.Item, error) {
 
 	if p.Country != "" {
 		query += " AND (countries.name = ? OR countries.name IS NULL)"
-		queryParams = append(queryParams, p.Country)
+		query += " AND NOT EXISTS (SELECT 1 FROM banner_excluded_country JOIN countries ec ON ec.id = banner_excluded_country.country_id WHERE banner_excluded_country.banner_id = banners.id AND ec.name = ?)"
+		queryParams = append(queryParams, p.Country, p.Country)
 	}
 
 	if p.Gender != "" {
 		query += " AND (genders.name = ? OR genders.name IS NULL)"
-		queryParams = append(queryParams, p.Gender)
+		query += " AND NOT EXISTS (SELECT 1 FROM banner_excluded_gender JOIN genders eg ON eg.id = banner_excluded_gender.gender_id WHERE banner_excluded_gender.banner_id = banners.id AND eg.name = ?)"
+		queryParams = append(queryParams, p.Gender, p.Gender)
 	}
 
 	if p.Platform != "" {
 		query += " AND (platforms.name = ? OR platforms.name IS NULL)"
-		queryParams = append(queryParams, p.Platform)
+		query += " AND NOT EXISTS (SELECT 1 FROM banner_excluded_platform JOIN platforms ep ON ep.id = banner_excluded_platform.platform_id WHERE banner_excluded_platform.banner_id = banners.id AND ep.name = ?)"
+		queryParams = append(queryParams, p.Platform, p.Platform)
 	}
-	res := DB.
-		Distinct("banners.id, banners.title, banners.end_at").
+
+	return query, queryParams
+}
+
+func joinConditions(tx *gorm.DB) *gorm.DB {
+	return tx.
 		Joins("LEFT OUTER JOIN banner_gender ON banners.id = banner_gender.banner_id").
 		Joins("LEFT OUTER JOIN genders ON genders.id = banner_gender.gender_id").
 		Joins("LEFT OUTER JOIN banner_country ON banners.id = banner_country.banner_id").
 		Joins("LEFT OUTER JOIN countries ON countries.id = banner_country.country_id").
 		Joins("LEFT OUTER JOIN banner_platform ON banners.id = banner_platform.banner_id").
-		Joins("LEFT OUTER JOIN platforms ON platforms.id = banner_platform.platform_id").
-		Where(query, queryParams...).Order("end_at asc").Find(&banners)
+		Joins("LEFT OUTER JOIN platforms ON platforms.id = banner_platform.platform_id")
+}
+
+// drops the banners that should not be served to the requester, applied before pagination
+type BannerFilter func(banners []Banner) ([]Banner, error)
+
+// every search reads the database, so other instances' writes show up right away
+func (s *GormStore) MaxStaleness() time.Duration {
+	return 0
+}
+
+// every eligible banner in order, the caller picks the page so the whole list can be cached once
+func (s *GormStore) SearchBanner(p utils.PublicParams, filters ...BannerFilter) ([]utils.Item, error) {
+	var banners []Banner
+	now := time.Now()
+	// the current time is a parameter rather than NOW(), which not every database has
+	query := "? BETWEEN banners.start_at AND banners.end_at AND banners.status IN ?"
+	queryParams := []interface{}{now, servingStatuses}
+
+	scheduled, scheduleParams := scheduleQuery(now.In(p.Location()))
+	query += " AND " + scheduled
+	queryParams = append(queryParams, scheduleParams...)
+
+	targeted, targetParams := targetingQuery(p)
+	query += targeted
+	queryParams = append(queryParams, targetParams...)
+
+	res := s.db.
+		Distinct("banners.id, banners.title, banners.creative_rotation, banners.priority, banners.weight, banners.cap_hourly, banners.cap_daily, banners.cap_lifetime, banners.daily_budget, banners.lifetime_budget, banners.start_at, banners.end_at").
+		Scopes(joinConditions).
+		Where(query, queryParams...).Order(rankOrder(p.Rank)).Find(&banners)
 
 	err := res.Error
 	if err != nil {
 		return nil, err
 	}
 
-	var items []utils.Item
-	for i, b := range banners {
-		if i >= p.Offset && i < p.Offset+p.Limit {
-			items = append(items, utils.Item{Title: b.Title, EndAt: b.EndAt})
+	if p.Rank == RankWeighted {
+		weightedShuffle(banners)
+	}
+
+	for _, filter := range filters {
+		if banners, err = filter(banners); err != nil {
+			return nil, err
 		}
 	}
+
+	var items []utils.Item
+	rotations := map[uint]string{}
+	for _, b := range banners {
+		items = append(items, utils.Item{ID: b.ID, Title: b.Title, EndAt: b.EndAt})
+		rotations[b.ID] = b.CreativeRotation
+	}
+
+	if err := attachCreatives(s.db, items, rotations); err != nil {
+		return nil, err
+	}
 	return items, nil
 }
+
+// the earliest start or end of a banner the given query can match, so cached responses can expire with it.
+// false means no such banner is live or upcoming
+func (s *GormStore) NextBannerBoundary(p utils.PublicParams, now time.Time) (time.Time, bool, error) {
+	query := "banners.end_at > ? AND banners.status IN ?"
+	queryParams := []interface{}{now, servingStatuses}
+
+	targeted, targetParams := targetingQuery(p)
+	query += targeted
+	queryParams = append(queryParams, targetParams...)
+
+	var starts, ends []time.Time
+	err := s.db.Model(&Banner{}).Scopes(joinConditions).
+		Where(query+" AND banners.start_at > ?", append(queryParams, now)...).
+		Order("banners.start_at").Limit(1).Pluck("banners.start_at", &starts).Error
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	err = s.db.Model(&Banner{}).Scopes(joinConditions).
+		Where(query, queryParams...).
+		Order("banners.end_at").Limit(1).Pluck("banners.end_at", &ends).Error
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	if len(ends) == 0 {
+		return time.Time{}, false, nil
+	}
+	if len(starts) != 0 && starts[0].Before(ends[0]) {
+		return starts[0], true, nil
+	}
+	return ends[0], true, nil
+}
+
+// banners that started or ended in (from, to], with their conditions
+func (s *GormStore) CrossedBanners(from, to time.Time) ([]Banner, error) {
+	var banners []Banner
+	err := withConditions(s.db).
+		Where("status IN ?", servingStatuses).
+		Where("(start_at > ? AND start_at <= ? OR end_at > ? AND end_at <= ?)", from, to, from, to).
+		Find(&banners).Error
+	return banners, err
+}
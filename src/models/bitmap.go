@@ -0,0 +1,62 @@
+package models
+
+import "math/bits"
+
+// a set of index slots, bit i is set when slot i is in the set
+type bitmap []uint64
+
+func (b *bitmap) set(i int) {
+	for len(*b) <= i/64 {
+		*b = append(*b, 0)
+	}
+	(*b)[i/64] |= 1 << uint(i%64)
+}
+
+func (b bitmap) clear(i int) {
+	if i/64 < len(b) {
+		b[i/64] &^= 1 << uint(i%64)
+	}
+}
+
+func (b bitmap) and(o bitmap) bitmap {
+	n := len(b)
+	if len(o) < n {
+		n = len(o)
+	}
+	out := make(bitmap, n)
+	for i := range out {
+		out[i] = b[i] & o[i]
+	}
+	return out
+}
+
+func (b bitmap) or(o bitmap) bitmap {
+	if len(b) < len(o) {
+		b, o = o, b
+	}
+	out := append(bitmap(nil), b...)
+	for i := range o {
+		out[i] |= o[i]
+	}
+	return out
+}
+
+func (b bitmap) andNot(o bitmap) bitmap {
+	out := append(bitmap(nil), b...)
+	for i := range out {
+		if i < len(o) {
+			out[i] &^= o[i]
+		}
+	}
+	return out
+}
+
+// calls fn with every slot in the set, in ascending order
+func (b bitmap) each(fn func(i int)) {
+	for w, word := range b {
+		for word != 0 {
+			fn(w*64 + bits.TrailingZeros64(word))
+			word &= word - 1
+		}
+	}
+}
@@ -13,36 +13,38 @@ import (
 
 var DB *gorm.DB
 
+// opens the database picked by DB_DRIVER (postgres or sqlite), TEST_DB_* when APP_ENV is test,
+// and applies the pending migrations unless DB_MIGRATE_ON_START is false
 func Init() {
-	var dsn string
+	prefix := "DB_"
 	if os.Getenv("APP_ENV") == "test" {
-		dsn = fmt.Sprintf(
-			"host=%s user=%s password=%s dbname=%s port=%s sslmode=disable TimeZone=Asia/Taipei",
-			os.Getenv("TEST_DB_HOST"),
-			os.Getenv("TEST_DB_USER"),
-			os.Getenv("TEST_DB_PASSWORD"),
-			os.Getenv("TEST_DB_DATABASE"),
-			os.Getenv("TEST_DB_PORT"),
-		)
+		prefix = "TEST_DB_"
+	}
+
+	driver := os.Getenv(prefix + "DRIVER")
+	var dialector gorm.Dialector
+	if driver == "sqlite" {
+		dialector = openSQLite(os.Getenv(prefix + "PATH"))
 	} else {
-		dsn = fmt.Sprintf(
+		dsn := fmt.Sprintf(
 			"host=%s user=%s password=%s dbname=%s port=%s sslmode=disable TimeZone=Asia/Taipei",
-			os.Getenv("DB_HOST"),
-			os.Getenv("DB_USER"),
-			os.Getenv("DB_PASSWORD"),
-			os.Getenv("DB_DATABASE"),
-			os.Getenv("DB_PORT"),
+			os.Getenv(prefix+"HOST"),
+			os.Getenv(prefix+"USER"),
+			os.Getenv(prefix+"PASSWORD"),
+			os.Getenv(prefix+"DATABASE"),
+			os.Getenv(prefix+"PORT"),
 		)
+		dialector = postgres.Open(dsn)
 	}
 
-	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+	conn, err := gorm.Open(dialector, &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Silent),
 	})
 
 	if err != nil {
 		for i := 0; i < 10; i++ {
 			fmt.Println("Failed to connect to database. Retrying...")
-			conn, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+			conn, err = gorm.Open(dialector, &gorm.Config{})
 			if err == nil {
 				break
 			}
@@ -56,11 +58,22 @@ func Init() {
 
 	sqlDb, _ := conn.DB()
 
-	maxConn, _ := strconv.Atoi(os.Getenv("DB_MAX_CONN"))
-	maxIdle, _ := strconv.Atoi(os.Getenv("DB_MAX_IDLE"))
-	sqlDb.SetMaxIdleConns(maxConn)
-	sqlDb.SetMaxOpenConns(maxIdle)
+	if driver == "sqlite" {
+		// sqlite takes one writer at a time, and an in-memory database lives only as long as its connection
+		sqlDb.SetMaxOpenConns(1)
+		sqlDb.SetMaxIdleConns(1)
+	} else {
+		maxConn, _ := strconv.Atoi(os.Getenv("DB_MAX_CONN"))
+		maxIdle, _ := strconv.Atoi(os.Getenv("DB_MAX_IDLE"))
+		sqlDb.SetMaxIdleConns(maxConn)
+		sqlDb.SetMaxOpenConns(maxIdle)
+	}
 
 	DB = conn
-	DB.AutoMigrate(&Banner{}, &Gender{}, &Country{}, &Platform{})
+	if os.Getenv("DB_MIGRATE_ON_START") == "false" {
+		return
+	}
+	if _, err := MigrateUp(DB); err != nil {
+		panic(err)
+	}
 }
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"errors"
+	"main/utils"
+
+	"gorm.io/gorm"
+)
+
+var ErrCreativeNotFound = errors.New("creative not found")
+
+// how the creative of a banner is picked on every serve
+const (
+	RotationEven     = "even"
+	RotationWeighted = "weighted"
+)
+
+type Creative struct {
+	ID       uint
+	BannerID uint `gorm:"index"`
+	ImageURL string
+	LinkURL  string
+	CTAText  string
+	Width    int
+	Height   int
+	AltText  string
+	Weight   int `gorm:"default:1"`
+}
+
+func (c *Creative) Detail() utils.CreativeDetail {
+	return utils.CreativeDetail{
+		ID: c.ID,
+		CreativeParams: utils.CreativeParams{
+			ImageURL: c.ImageURL,
+			LinkURL:  c.LinkURL,
+			CTAText:  c.CTAText,
+			Width:    c.Width,
+			Height:   c.Height,
+			AltText:  c.AltText,
+			Weight:   c.Weight,
+		},
+	}
+}
+
+func (c *Creative) Item() utils.CreativeItem {
+	return utils.CreativeItem{
+		ID:       c.ID,
+		ImageURL: c.ImageURL,
+		LinkURL:  c.LinkURL,
+		CTAText:  c.CTAText,
+		Width:    c.Width,
+		Height:   c.Height,
+		AltText:  c.AltText,
+		Weight:   c.Weight,
+	}
+}
+
+func buildCreative(bannerID uint, p utils.CreativeParams) Creative {
+	return Creative{
+		BannerID: bannerID,
+		ImageURL: p.ImageURL,
+		LinkURL:  p.LinkURL,
+		CTAText:  p.CTAText,
+		Width:    p.Width,
+		Height:   p.Height,
+		AltText:  p.AltText,
+		Weight:   p.Weight,
+	}
+}
+
+func (s *GormStore) ListCreatives(bannerID uint) ([]Creative, error) {
+	if _, err := s.GetBanner(bannerID); err != nil {
+		return nil, err
+	}
+
+	var creatives []Creative
+	err := s.db.Where("banner_id = ?", bannerID).Order("id asc").Find(&creatives).Error
+	return creatives, err
+}
+
+func (s *GormStore) CreateCreative(bannerID uint, p utils.CreativeParams) (uint, error) {
+	if _, err := s.GetBanner(bannerID); err != nil {
+		return 0, err
+	}
+
+	creative := buildCreative(bannerID, p)
+	if err := s.db.Create(&creative).Error; err != nil {
+		return 0, err
+	}
+	return creative.ID, nil
+}
+
+func (s *GormStore) UpdateCreative(bannerID, id uint, p utils.CreativeParams) error {
+	creative := buildCreative(bannerID, p)
+
+	res := s.db.Model(&Creative{}).Where("id = ? AND banner_id = ?", id, bannerID).
+		Select("image_url", "link_url", "cta_text", "width", "height", "alt_text", "weight").Updates(&creative)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrCreativeNotFound
+	}
+	return nil
+}
+
+func (s *GormStore) DeleteCreative(bannerID, id uint) error {
+	res := s.db.Where("id = ? AND banner_id = ?", id, bannerID).Delete(&Creative{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrCreativeNotFound
+	}
+	return nil
+}
+
+// attaches the creatives of every item's banner as the candidates to rotate between
+func attachCreatives(db *gorm.DB, items []utils.Item, rotations map[uint]string) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	ids := []uint{}
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+
+	var creatives []Creative
+	if err := db.Where("banner_id IN ?", ids).Order("id asc").Find(&creatives).Error; err != nil {
+		return err
+	}
+
+	byBanner := map[uint][]utils.CreativeItem{}
+	for _, c := range creatives {
+		byBanner[c.BannerID] = append(byBanner[c.BannerID], c.Item())
+	}
+
+	for i := range items {
+		items[i].Creatives = byBanner[items[i].ID]
+		if len(items[i].Creatives) != 0 {
+			items[i].Rotation = rotations[items[i].ID]
+		}
+	}
+	return nil
+}
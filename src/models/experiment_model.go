@@ -0,0 +1,236 @@
+package models
+
+import (
+	"errors"
+	"hash/fnv"
+	"main/utils"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrExperimentNotFound = errors.New("experiment not found")
+	ErrExperimentRunning  = errors.New("banner already has a running experiment")
+	ErrExperimentEnded    = errors.New("experiment is not running")
+	ErrVariantNotFound    = errors.New("variant not found")
+)
+
+const (
+	ExperimentRunning   = "running"
+	ExperimentCompleted = "completed"
+)
+
+// splits the users matching a banner between variants of its title and creative
+type Experiment struct {
+	ID              uint
+	BannerID        uint   `gorm:"index"`
+	Status          string `gorm:"default:running"`
+	WinnerVariantID uint
+	Variants        []Variant `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// empty Title or zero CreativeID keep the banner's own
+type Variant struct {
+	ID           uint
+	ExperimentID uint `gorm:"index"`
+	Name         string
+	Title        string
+	CreativeID   uint
+	Weight       int `gorm:"default:1"`
+	// counters copied from redis when the experiment completes
+	Exposures int64
+	Clicks    int64
+}
+
+// the variant the user is bucketed into, the same user always lands in the same one
+func (e *Experiment) Assign(userID string) *Variant {
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(userID + ":" + strconv.FormatUint(uint64(e.ID), 10)))
+	bucket := int(h.Sum32() % uint32(total))
+
+	for i := range e.Variants {
+		if bucket -= e.Variants[i].Weight; bucket < 0 {
+			return &e.Variants[i]
+		}
+	}
+	return nil
+}
+
+// the variant to promote, failing when the experiment already ended or the variant is not part of it
+func (e *Experiment) promotable(variantID uint) (*Variant, error) {
+	if e.Status != ExperimentRunning {
+		return nil, ErrExperimentEnded
+	}
+
+	for i := range e.Variants {
+		if e.Variants[i].ID == variantID {
+			return &e.Variants[i], nil
+		}
+	}
+	return nil, ErrVariantNotFound
+}
+
+func (e *Experiment) Detail() utils.ExperimentDetail {
+	variants := []utils.VariantDetail{}
+	for _, v := range e.Variants {
+		variants = append(variants, utils.VariantDetail{
+			ID: v.ID,
+			VariantParams: utils.VariantParams{
+				Name:       v.Name,
+				Title:      v.Title,
+				CreativeID: v.CreativeID,
+				Weight:     v.Weight,
+			},
+			Exposures: v.Exposures,
+			Clicks:    v.Clicks,
+		})
+	}
+
+	return utils.ExperimentDetail{
+		ID:              e.ID,
+		BannerID:        e.BannerID,
+		Status:          e.Status,
+		WinnerVariantID: e.WinnerVariantID,
+		Variants:        variants,
+	}
+}
+
+func (s *GormStore) CreateExperiment(p utils.ExperimentParams) (uint, error) {
+	experiment := Experiment{BannerID: p.BannerID, Status: ExperimentRunning}
+	for _, v := range p.Variants {
+		experiment.Variants = append(experiment.Variants, Variant{Name: v.Name, Title: v.Title, CreativeID: v.CreativeID, Weight: v.Weight})
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var banner Banner
+		if err := tx.Preload("Creatives").First(&banner, p.BannerID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrBannerNotFound
+			}
+			return err
+		}
+
+		creatives := map[uint]bool{}
+		for _, c := range banner.Creatives {
+			creatives[c.ID] = true
+		}
+		for _, v := range p.Variants {
+			if v.CreativeID != 0 && !creatives[v.CreativeID] {
+				return ErrCreativeNotFound
+			}
+		}
+
+		var running int64
+		if err := tx.Model(&Experiment{}).Where("banner_id = ? AND status = ?", p.BannerID, ExperimentRunning).Count(&running).Error; err != nil {
+			return err
+		}
+		if running != 0 {
+			return ErrExperimentRunning
+		}
+
+		return tx.Create(&experiment).Error
+	})
+	return experiment.ID, err
+}
+
+func (s *GormStore) GetExperiment(id uint) (Experiment, error) {
+	var experiment Experiment
+	err := s.db.Preload("Variants", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id asc")
+	}).First(&experiment, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return experiment, ErrExperimentNotFound
+	}
+	return experiment, err
+}
+
+// key: banner id, value: the running experiment of the banner
+func (s *GormStore) RunningExperiments(bannerIDs []uint) (map[uint]Experiment, error) {
+	running := map[uint]Experiment{}
+	if len(bannerIDs) == 0 {
+		return running, nil
+	}
+
+	var experiments []Experiment
+	err := s.db.Preload("Variants", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id asc")
+	}).Where("banner_id IN ? AND status = ?", bannerIDs, ExperimentRunning).Find(&experiments).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range experiments {
+		running[e.BannerID] = e
+	}
+	return running, nil
+}
+
+// ends the experiment and makes the winner's title and creative the banner's own.
+// the other creatives of the banner are removed when the winner has one.
+// exposures and clicks hold the final counts of each variant, key: variant id
+func (s *GormStore) PromoteVariant(actor string, id, variantID uint, exposures, clicks map[uint]int64) (Experiment, error) {
+	experiment, err := s.GetExperiment(id)
+	if err != nil {
+		return experiment, err
+	}
+
+	winner, err := experiment.promotable(variantID)
+	if err != nil {
+		return experiment, err
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&Experiment{}).Where("id = ? AND status = ?", id, ExperimentRunning).
+			Updates(map[string]interface{}{"status": ExperimentCompleted, "winner_variant_id": variantID})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrExperimentEnded
+		}
+
+		for _, v := range experiment.Variants {
+			err := tx.Model(&Variant{}).Where("id = ?", v.ID).
+				Updates(map[string]interface{}{"exposures": exposures[v.ID], "clicks": clicks[v.ID]}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		// the new title is recorded in the banner's history, the creatives are not part of it
+		if winner.Title != "" {
+			banner, err := getBanner(tx, experiment.BannerID)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&Banner{}).Where("id = ?", banner.ID).Update("title", winner.Title).Error; err != nil {
+				return err
+			}
+
+			after := banner.clone()
+			after.Title = winner.Title
+			if err := tx.Create(newRevision(actor, RevisionUpdate, banner.ID, &banner, &after)).Error; err != nil {
+				return err
+			}
+		}
+
+		if winner.CreativeID != 0 {
+			return tx.Where("banner_id = ? AND id <> ?", experiment.BannerID, winner.CreativeID).Delete(&Creative{}).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return experiment, err
+	}
+
+	return s.GetExperiment(id)
+}
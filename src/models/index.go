@@ -0,0 +1,423 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"main/utils"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// oldest age a query can ask for, older ones only match banners without an age range
+const maxIndexedAge = 100
+
+// banners loaded per page when the index is built
+const indexPageSize = 500
+
+// longest the live set is kept when no banner starts or ends
+const maxLiveRefresh = time.Hour
+
+// the banners targeting, excluding or not caring about each value of one dimension
+type dimensionIndex struct {
+	targeted   map[string]bitmap
+	excluded   map[string]bitmap
+	untargeted bitmap
+}
+
+func newDimensionIndex() *dimensionIndex {
+	return &dimensionIndex{targeted: map[string]bitmap{}, excluded: map[string]bitmap{}}
+}
+
+func (d *dimensionIndex) add(slot int, targeted, excluded []string) {
+	if len(targeted) == 0 {
+		d.untargeted.set(slot)
+	}
+	for _, v := range targeted {
+		b := d.targeted[v]
+		b.set(slot)
+		d.targeted[v] = b
+	}
+	for _, v := range excluded {
+		b := d.excluded[v]
+		b.set(slot)
+		d.excluded[v] = b
+	}
+}
+
+func (d *dimensionIndex) remove(slot int, targeted, excluded []string) {
+	d.untargeted.clear(slot)
+	for _, v := range targeted {
+		d.targeted[v].clear(slot)
+	}
+	for _, v := range excluded {
+		d.excluded[v].clear(slot)
+	}
+}
+
+// the banners a query with this value can see, the same rule as targetingQuery
+func (d *dimensionIndex) match(value string) bitmap {
+	return d.untargeted.or(d.targeted[value]).andNot(d.excluded[value])
+}
+
+// every banner that is serving and has not ended yet, by slot
+type bannerIndex struct {
+	slots []*Banner
+	free  []int
+	byID  map[uint]int
+	all   bitmap
+	// banners inside their start and end at the last refresh, valid until liveUntil
+	live      bitmap
+	liveUntil time.Time
+
+	anyAge   bitmap
+	ages     [maxIndexedAge + 1]bitmap
+	country  *dimensionIndex
+	gender   *dimensionIndex
+	platform *dimensionIndex
+}
+
+func newBannerIndex() *bannerIndex {
+	return &bannerIndex{
+		byID:     map[uint]int{},
+		country:  newDimensionIndex(),
+		gender:   newDimensionIndex(),
+		platform: newDimensionIndex(),
+	}
+}
+
+func (x *bannerIndex) put(b Banner) {
+	x.remove(b.ID)
+
+	slot := len(x.slots)
+	if len(x.free) != 0 {
+		slot = x.free[len(x.free)-1]
+		x.free = x.free[:len(x.free)-1]
+	} else {
+		x.slots = append(x.slots, nil)
+	}
+	x.slots[slot] = &b
+	x.byID[b.ID] = slot
+	x.all.set(slot)
+
+	if b.AgeStart == 0 && b.AgeEnd == 0 {
+		x.anyAge.set(slot)
+	}
+	for age := b.AgeStart; age <= b.AgeEnd && age <= maxIndexedAge; age++ {
+		x.ages[age].set(slot)
+	}
+
+	x.country.add(slot, countryNames(b.Countries), countryNames(b.ExcludedCountries))
+	x.gender.add(slot, genderNames(b.Genders), genderNames(b.ExcludedGenders))
+	x.platform.add(slot, platformNames(b.Platforms), platformNames(b.ExcludedPlatforms))
+
+	// the live set is rebuilt by the next query
+	x.liveUntil = time.Time{}
+}
+
+func (x *bannerIndex) remove(id uint) {
+	slot, ok := x.byID[id]
+	if !ok {
+		return
+	}
+	b := x.slots[slot]
+
+	x.all.clear(slot)
+	x.live.clear(slot)
+	x.anyAge.clear(slot)
+	for age := b.AgeStart; age <= b.AgeEnd && age <= maxIndexedAge; age++ {
+		x.ages[age].clear(slot)
+	}
+	x.country.remove(slot, countryNames(b.Countries), countryNames(b.ExcludedCountries))
+	x.gender.remove(slot, genderNames(b.Genders), genderNames(b.ExcludedGenders))
+	x.platform.remove(slot, platformNames(b.Platforms), platformNames(b.ExcludedPlatforms))
+
+	x.slots[slot] = nil
+	x.free = append(x.free, slot)
+	delete(x.byID, id)
+}
+
+// the banners matching the targeting of the query, whether they are live or not
+func (x *bannerIndex) match(p utils.PublicParams) bitmap {
+	matched := x.all
+	if p.Age != 0 {
+		ages := x.anyAge
+		if p.Age > 0 && p.Age <= maxIndexedAge {
+			ages = ages.or(x.ages[p.Age])
+		}
+		matched = matched.and(ages)
+	}
+	if p.Country != "" {
+		matched = matched.and(x.country.match(p.Country))
+	}
+	if p.Gender != "" {
+		matched = matched.and(x.gender.match(p.Gender))
+	}
+	if p.Platform != "" {
+		matched = matched.and(x.platform.match(p.Platform))
+	}
+	return matched
+}
+
+// whether the live set has to be rebuilt because a banner started or ended since
+func (x *bannerIndex) stale(now time.Time) bool {
+	return !now.Before(x.liveUntil)
+}
+
+// rebuilds the live set and drops the banners that ended
+func (x *bannerIndex) refreshLive(now time.Time) {
+	x.live = nil
+	x.liveUntil = time.Time{}
+	for slot, b := range x.slots {
+		if b == nil {
+			continue
+		}
+		if now.After(b.EndAt) {
+			x.remove(b.ID)
+			continue
+		}
+
+		// a banner stops being live right after its end, see the BETWEEN in SearchBanner
+		until := b.EndAt.Add(time.Nanosecond)
+		if now.Before(b.StartAt) {
+			until = b.StartAt
+		} else {
+			x.live.set(slot)
+		}
+		if x.liveUntil.IsZero() || until.Before(x.liveUntil) {
+			x.liveUntil = until
+		}
+	}
+	if x.liveUntil.IsZero() {
+		x.liveUntil = now.Add(maxLiveRefresh)
+	}
+}
+
+// the banners in the slots, ordered by id like the database returns them
+func (x *bannerIndex) banners(slots bitmap) []*Banner {
+	var banners []*Banner
+	slots.each(func(slot int) {
+		banners = append(banners, x.slots[slot])
+	})
+	sort.Slice(banners, func(i, j int) bool {
+		return banners[i].ID < banners[j].ID
+	})
+	return banners
+}
+
+// answers the public search from bitmaps held in memory instead of joining the condition tables.
+// writes go through to the wrapped store and update the index, changes made by other instances
+// arrive through Refresh and are caught up on when Load runs again, see jobs.StartIndexReloader
+type IndexedStore struct {
+	BannerStore
+	// called with every banner written through this instance, so the other instances can refresh it
+	Notify func(id uint)
+
+	mu    sync.RWMutex
+	index *bannerIndex
+}
+
+// how often the index is rebuilt, BANNER_INDEX_RELOAD seconds (default 30). a write of another
+// instance whose notification got lost is only seen after it
+func IndexReloadInterval() time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv("BANNER_INDEX_RELOAD")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return 30 * time.Second
+}
+
+func NewIndexedStore(store BannerStore) *IndexedStore {
+	return &IndexedStore{BannerStore: store, index: newBannerIndex()}
+}
+
+// rebuilds the index from every serving banner of the wrapped store
+func (s *IndexedStore) Load() error {
+	index := newBannerIndex()
+	now := time.Now()
+
+	for _, status := range servingStatuses {
+		for offset := 0; ; offset += indexPageSize {
+			banners, _, err := s.BannerStore.ListBanners(utils.ListParams{Status: status, Limit: indexPageSize, Offset: offset})
+			if err != nil {
+				return err
+			}
+			for _, b := range banners {
+				if !now.After(b.EndAt) {
+					index.put(b)
+				}
+			}
+			if len(banners) < indexPageSize {
+				break
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.index = index
+	s.mu.Unlock()
+	return nil
+}
+
+// reloads one banner after a write of this instance and tells the others about it
+func (s *IndexedStore) refresh(id uint) {
+	s.Refresh(id)
+	if s.Notify != nil {
+		s.Notify(id)
+	}
+}
+
+// reloads one banner, a failure leaves the index stale until the next Load
+func (s *IndexedStore) Refresh(id uint) {
+	banner, err := s.BannerStore.GetBanner(id)
+	if err != nil && !errors.Is(err, ErrBannerNotFound) {
+		fmt.Println(err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if errors.Is(err, ErrBannerNotFound) || !isServing(&banner) || time.Now().After(banner.EndAt) {
+		s.index.remove(id)
+		return
+	}
+	s.index.put(banner)
+}
+
+// the live banners matching the query, rebuilding the live set first when a banner started or ended
+func (s *IndexedStore) liveMatches(p utils.PublicParams, now time.Time) []Banner {
+	s.mu.RLock()
+	if s.index.stale(now) {
+		s.mu.RUnlock()
+		s.mu.Lock()
+		if s.index.stale(now) {
+			s.index.refreshLive(now)
+		}
+		s.mu.Unlock()
+		s.mu.RLock()
+	}
+	defer s.mu.RUnlock()
+
+	var banners []Banner
+	for _, b := range s.index.banners(s.index.match(p).and(s.index.live)) {
+		banners = append(banners, b.clone())
+	}
+	return banners
+}
+
+func (s *IndexedStore) SearchBanner(p utils.PublicParams, filters ...BannerFilter) ([]utils.Item, error) {
+	now := time.Now()
+	local := now.In(p.Location())
+
+	var banners []Banner
+	for _, b := range s.liveMatches(p, now) {
+		if scheduledAt(b.Schedules, local) {
+			banners = append(banners, b)
+		}
+	}
+	return rankedItems(banners, p.Rank, filters)
+}
+
+// another instance's write whose notification got lost is only seen after the next reload
+func (s *IndexedStore) MaxStaleness() time.Duration {
+	return IndexReloadInterval()
+}
+
+func (s *IndexedStore) NextBannerBoundary(p utils.PublicParams, now time.Time) (time.Time, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	next, ok := nextBoundary(s.index.banners(s.index.match(p)), now)
+	return next, ok, nil
+}
+
+func (s *IndexedStore) NextScheduleChange(now time.Time) (time.Duration, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var schedules []BannerSchedule
+	for _, b := range s.index.banners(s.index.all) {
+		if !now.Before(b.StartAt) && !now.After(b.EndAt) {
+			schedules = append(schedules, b.Schedules...)
+		}
+	}
+	if len(schedules) == 0 {
+		return 0, false, nil
+	}
+	return nextScheduleChange(schedules, now), true, nil
+}
+
+func (s *IndexedStore) CreateBanner(actor string, p utils.AdminParams) (uint, error) {
+	id, err := s.BannerStore.CreateBanner(actor, p)
+	if err == nil {
+		s.refresh(id)
+	}
+	return id, err
+}
+
+func (s *IndexedStore) UpdateBanner(actor string, id uint, p utils.AdminParams) error {
+	err := s.BannerStore.UpdateBanner(actor, id, p)
+	if err == nil {
+		s.refresh(id)
+	}
+	return err
+}
+
+func (s *IndexedStore) TransitionBanner(actor string, id uint, to string) (Banner, error) {
+	banner, err := s.BannerStore.TransitionBanner(actor, id, to)
+	if err == nil {
+		s.refresh(id)
+	}
+	return banner, err
+}
+
+func (s *IndexedStore) DeleteBanner(actor string, id uint) error {
+	err := s.BannerStore.DeleteBanner(actor, id)
+	if err == nil {
+		s.refresh(id)
+	}
+	return err
+}
+
+func (s *IndexedStore) RestoreBanner(actor string, id, revisionID uint) (BannerRevision, error) {
+	revision, err := s.BannerStore.RestoreBanner(actor, id, revisionID)
+	if err == nil {
+		s.refresh(id)
+	}
+	return revision, err
+}
+
+// creatives are served with their banner, so the banner is reloaded with them
+func (s *IndexedStore) CreateCreative(bannerID uint, p utils.CreativeParams) (uint, error) {
+	id, err := s.BannerStore.CreateCreative(bannerID, p)
+	if err == nil {
+		s.refresh(bannerID)
+	}
+	return id, err
+}
+
+func (s *IndexedStore) UpdateCreative(bannerID, id uint, p utils.CreativeParams) error {
+	err := s.BannerStore.UpdateCreative(bannerID, id, p)
+	if err == nil {
+		s.refresh(bannerID)
+	}
+	return err
+}
+
+func (s *IndexedStore) DeleteCreative(bannerID, id uint) error {
+	err := s.BannerStore.DeleteCreative(bannerID, id)
+	if err == nil {
+		s.refresh(bannerID)
+	}
+	return err
+}
+
+// the winning variant's title and creative are written onto the banner
+func (s *IndexedStore) PromoteVariant(actor string, id, variantID uint, exposures, clicks map[uint]int64) (Experiment, error) {
+	experiment, err := s.BannerStore.PromoteVariant(actor, id, variantID, exposures, clicks)
+	if err == nil {
+		s.refresh(experiment.BannerID)
+	}
+	return experiment, err
+}
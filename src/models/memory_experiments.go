@@ -0,0 +1,161 @@
+package models
+
+import (
+	"main/utils"
+	"sort"
+)
+
+// a copy the caller may keep
+func (e *Experiment) clone() Experiment {
+	c := *e
+	c.Variants = append([]Variant(nil), e.Variants...)
+	return c
+}
+
+func (s *MemoryStore) CreateExperiment(p utils.ExperimentParams) (uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	banner, ok := s.banners[p.BannerID]
+	if !ok {
+		return 0, ErrBannerNotFound
+	}
+	for _, v := range p.Variants {
+		if _, i := s.creativeIndex(banner.ID, v.CreativeID); v.CreativeID != 0 && i < 0 {
+			return 0, ErrCreativeNotFound
+		}
+	}
+	for _, e := range s.experiments {
+		if e.BannerID == p.BannerID && e.Status == ExperimentRunning {
+			return 0, ErrExperimentRunning
+		}
+	}
+
+	s.lastExperimentID++
+	experiment := Experiment{ID: s.lastExperimentID, BannerID: p.BannerID, Status: ExperimentRunning}
+	for _, v := range p.Variants {
+		s.lastVariantID++
+		experiment.Variants = append(experiment.Variants, Variant{ID: s.lastVariantID, ExperimentID: experiment.ID, Name: v.Name, Title: v.Title, CreativeID: v.CreativeID, Weight: v.Weight})
+	}
+
+	s.experiments[experiment.ID] = &experiment
+	return experiment.ID, nil
+}
+
+func (s *MemoryStore) GetExperiment(id uint) (Experiment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	experiment, ok := s.experiments[id]
+	if !ok {
+		return Experiment{}, ErrExperimentNotFound
+	}
+	return experiment.clone(), nil
+}
+
+func (s *MemoryStore) RunningExperiments(bannerIDs []uint) (map[uint]Experiment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	wanted := map[uint]bool{}
+	for _, id := range bannerIDs {
+		wanted[id] = true
+	}
+
+	running := map[uint]Experiment{}
+	for _, e := range s.experiments {
+		if wanted[e.BannerID] && e.Status == ExperimentRunning {
+			running[e.BannerID] = e.clone()
+		}
+	}
+	return running, nil
+}
+
+// see GormStore.PromoteVariant
+func (s *MemoryStore) PromoteVariant(actor string, id, variantID uint, exposures, clicks map[uint]int64) (Experiment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	experiment, ok := s.experiments[id]
+	if !ok {
+		return Experiment{}, ErrExperimentNotFound
+	}
+	winner, err := experiment.promotable(variantID)
+	if err != nil {
+		return experiment.clone(), err
+	}
+
+	promoted := experiment.clone()
+	promoted.Status = ExperimentCompleted
+	promoted.WinnerVariantID = variantID
+	for i, v := range promoted.Variants {
+		promoted.Variants[i].Exposures = exposures[v.ID]
+		promoted.Variants[i].Clicks = clicks[v.ID]
+	}
+
+	if banner, ok := s.banners[experiment.BannerID]; ok {
+		if winner.Title != "" {
+			before := banner.clone()
+			banner.Title = winner.Title
+			s.record(newRevision(actor, RevisionUpdate, banner.ID, &before, banner))
+		}
+		if winner.CreativeID != 0 {
+			var creatives []Creative
+			for _, c := range banner.Creatives {
+				if c.ID == winner.CreativeID {
+					creatives = append(creatives, c)
+				}
+			}
+			banner.Creatives = creatives
+		}
+	}
+
+	s.experiments[id] = &promoted
+	return promoted.clone(), nil
+}
+
+// adds the counts onto the stored ones, stats of banners that do not exist are dropped
+func (s *MemoryStore) AddStats(stats []BannerStat) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stat := range stats {
+		if _, ok := s.banners[stat.BannerID]; !ok {
+			continue
+		}
+
+		key := statKey{stat.BannerID, stat.Day.Format("2006-01-02")}
+		stored, ok := s.stats[key]
+		if !ok {
+			stored = &BannerStat{BannerID: stat.BannerID, Day: stat.Day}
+			s.stats[key] = stored
+		}
+		stored.Impressions += stat.Impressions
+		stored.Clicks += stat.Clicks
+	}
+	return nil
+}
+
+func (s *MemoryStore) Report(p utils.ReportParams) ([]utils.ReportItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var stats []BannerStat
+	for _, stat := range s.stats {
+		if p.BannerID != 0 && stat.BannerID != p.BannerID {
+			continue
+		}
+		if !p.From.IsZero() && stat.Day.Before(p.From) || !p.To.IsZero() && stat.Day.After(p.To) {
+			continue
+		}
+		stats = append(stats, *stat)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].BannerID != stats[j].BannerID {
+			return stats[i].BannerID < stats[j].BannerID
+		}
+		return stats[i].Day.Before(stats[j].Day)
+	})
+	return reportItems(stats), nil
+}
@@ -0,0 +1,403 @@
+package models
+
+import (
+	"main/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+// keeps the banners in memory with the same semantics as the database,
+// for tests and local runs without postgres. nothing survives a restart
+type MemoryStore struct {
+	mu               sync.RWMutex
+	banners          map[uint]*Banner
+	revisions        []BannerRevision
+	experiments      map[uint]*Experiment
+	stats            map[statKey]*BannerStat
+	lastBannerID     uint
+	lastCreativeID   uint
+	lastExperimentID uint
+	lastVariantID    uint
+}
+
+type statKey struct {
+	bannerID uint
+	day      string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{banners: map[uint]*Banner{}, experiments: map[uint]*Experiment{}, stats: map[statKey]*BannerStat{}}
+}
+
+// a copy the caller may keep, the stored banner only changes through the store
+func (b *Banner) clone() Banner {
+	c := *b
+	c.Schedules = append([]BannerSchedule(nil), b.Schedules...)
+	c.Creatives = append([]Creative(nil), b.Creatives...)
+	return c
+}
+
+// the defaults the database columns would fill in
+func withDefaults(b Banner) Banner {
+	if b.Status == "" {
+		b.Status = StatusActive
+	}
+	if b.Weight == 0 {
+		b.Weight = 1
+	}
+	if b.CreativeRotation == "" {
+		b.CreativeRotation = RotationEven
+	}
+	return b
+}
+
+// keeps the revision, the caller holds the lock
+func (s *MemoryStore) record(revision *BannerRevision) BannerRevision {
+	revision.ID = uint(len(s.revisions)) + 1
+	s.revisions = append(s.revisions, *revision)
+	return *revision
+}
+
+func (s *MemoryStore) CreateBanner(actor string, p utils.AdminParams) (uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	banner := withDefaults(buildBanner(p))
+	s.lastBannerID++
+	banner.ID = s.lastBannerID
+	for i := range banner.Schedules {
+		banner.Schedules[i].BannerID = banner.ID
+	}
+
+	s.banners[banner.ID] = &banner
+	s.record(newRevision(actor, RevisionCreate, banner.ID, nil, &banner))
+	return banner.ID, nil
+}
+
+func (s *MemoryStore) GetBanner(id uint) (Banner, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	banner, ok := s.banners[id]
+	if !ok {
+		return Banner{}, ErrBannerNotFound
+	}
+	return banner.clone(), nil
+}
+
+// every stored banner ordered by id
+func (s *MemoryStore) sorted() []*Banner {
+	banners := make([]*Banner, 0, len(s.banners))
+	for _, b := range s.banners {
+		banners = append(banners, b)
+	}
+	sort.Slice(banners, func(i, j int) bool {
+		return banners[i].ID < banners[j].ID
+	})
+	return banners
+}
+
+func (s *MemoryStore) ListBanners(p utils.ListParams) ([]Banner, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matched []*Banner
+	for _, b := range s.sorted() {
+		if p.Status == "" || b.Status == p.Status {
+			matched = append(matched, b)
+		}
+	}
+
+	var banners []Banner
+	for i := p.Offset; i < len(matched) && len(banners) < p.Limit; i++ {
+		banners = append(banners, matched[i].clone())
+	}
+	return banners, int64(len(matched)), nil
+}
+
+// replaces the banner's fields and all of its conditions, the status and creatives are kept
+func (s *MemoryStore) UpdateBanner(actor string, id uint, p utils.AdminParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.replace(newRevision(actor, RevisionUpdate, id, nil, nil), p)
+	return err
+}
+
+// replaces the banner of the revision with p and records the revision, the caller holds the lock
+func (s *MemoryStore) replace(revision *BannerRevision, p utils.AdminParams) (BannerRevision, error) {
+	id := revision.BannerID
+	old, ok := s.banners[id]
+	if !ok {
+		return BannerRevision{}, ErrBannerNotFound
+	}
+
+	banner := withDefaults(buildBanner(p))
+	banner.ID = id
+	banner.Status = old.Status
+	banner.Creatives = old.Creatives
+	for i := range banner.Schedules {
+		banner.Schedules[i].BannerID = id
+	}
+
+	s.banners[id] = &banner
+	revision.Before, revision.After = snapshot(old), snapshot(&banner)
+	return s.record(revision), nil
+}
+
+func (s *MemoryStore) TransitionBanner(actor string, id uint, to string) (Banner, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	banner, ok := s.banners[id]
+	if !ok {
+		return Banner{}, ErrBannerNotFound
+	}
+
+	before := banner.clone()
+	if !CanTransition(banner.Status, to) {
+		return before, ErrInvalidTransition
+	}
+
+	banner.Status = to
+	s.record(newRevision(actor, RevisionStatus, id, &before, banner))
+	return before, nil
+}
+
+func (s *MemoryStore) DeleteBanner(actor string, id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	banner, ok := s.banners[id]
+	if !ok {
+		return ErrBannerNotFound
+	}
+	delete(s.banners, id)
+	s.record(newRevision(actor, RevisionDelete, id, banner, nil))
+	return nil
+}
+
+func (s *MemoryStore) BannerHistory(id uint) ([]BannerRevision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var revisions []BannerRevision
+	for _, r := range s.revisions {
+		if r.BannerID == id {
+			revisions = append(revisions, r)
+		}
+	}
+	return revisions, nil
+}
+
+func (s *MemoryStore) RestoreBanner(actor string, id, revisionID uint) (BannerRevision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if revisionID == 0 || revisionID > uint(len(s.revisions)) || s.revisions[revisionID-1].BannerID != id {
+		return BannerRevision{}, ErrRevisionNotFound
+	}
+	revision := s.revisions[revisionID-1]
+
+	p, err := revision.State()
+	if err != nil {
+		return BannerRevision{}, err
+	}
+
+	restore := newRevision(actor, RevisionRestore, id, nil, nil)
+	restore.RestoredFrom = revision.ID
+	return s.replace(restore, p)
+}
+
+func (s *MemoryStore) ListCreatives(bannerID uint) ([]Creative, error) {
+	banner, err := s.GetBanner(bannerID)
+	if err != nil {
+		return nil, err
+	}
+	return banner.Creatives, nil
+}
+
+func (s *MemoryStore) CreateCreative(bannerID uint, p utils.CreativeParams) (uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	banner, ok := s.banners[bannerID]
+	if !ok {
+		return 0, ErrBannerNotFound
+	}
+
+	creative := buildCreative(bannerID, p)
+	if creative.Weight == 0 {
+		creative.Weight = 1
+	}
+	s.lastCreativeID++
+	creative.ID = s.lastCreativeID
+
+	banner.Creatives = append(append([]Creative(nil), banner.Creatives...), creative)
+	return creative.ID, nil
+}
+
+// the index of the creative in its banner, -1 if either does not exist
+func (s *MemoryStore) creativeIndex(bannerID, id uint) (*Banner, int) {
+	banner, ok := s.banners[bannerID]
+	if !ok {
+		return nil, -1
+	}
+	for i, c := range banner.Creatives {
+		if c.ID == id {
+			return banner, i
+		}
+	}
+	return banner, -1
+}
+
+func (s *MemoryStore) UpdateCreative(bannerID, id uint, p utils.CreativeParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	banner, i := s.creativeIndex(bannerID, id)
+	if i < 0 {
+		return ErrCreativeNotFound
+	}
+
+	creative := buildCreative(bannerID, p)
+	creative.ID = id
+	banner.Creatives = append([]Creative(nil), banner.Creatives...)
+	banner.Creatives[i] = creative
+	return nil
+}
+
+func (s *MemoryStore) DeleteCreative(bannerID, id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	banner, i := s.creativeIndex(bannerID, id)
+	if i < 0 {
+		return ErrCreativeNotFound
+	}
+
+	creatives := append([]Creative(nil), banner.Creatives[:i]...)
+	banner.Creatives = append(creatives, banner.Creatives[i+1:]...)
+	return nil
+}
+
+func isServing(b *Banner) bool {
+	return b.Status == StatusActive || b.Status == StatusScheduled
+}
+
+// the banners live in this process only, no other instance writes them
+func (s *MemoryStore) MaxStaleness() time.Duration {
+	return 0
+}
+
+// every eligible banner in the order of the requested rank, see GormStore.SearchBanner
+func (s *MemoryStore) SearchBanner(p utils.PublicParams, filters ...BannerFilter) ([]utils.Item, error) {
+	now := time.Now()
+	local := now.In(p.Location())
+
+	s.mu.RLock()
+	var banners []Banner
+	for _, b := range s.sorted() {
+		if !isServing(b) || now.Before(b.StartAt) || now.After(b.EndAt) {
+			continue
+		}
+		if !scheduledAt(b.Schedules, local) || !b.Conditions().Matches(p) {
+			continue
+		}
+		banners = append(banners, b.clone())
+	}
+	s.mu.RUnlock()
+
+	return rankedItems(banners, p.Rank, filters)
+}
+
+// orders the banners held in memory like the database would, filters them and
+// turns them into items with their creatives
+func rankedItems(banners []Banner, rank string, filters []BannerFilter) ([]utils.Item, error) {
+	rankBanners(banners, rank)
+
+	var err error
+	for _, filter := range filters {
+		if banners, err = filter(banners); err != nil {
+			return nil, err
+		}
+	}
+
+	var items []utils.Item
+	for _, b := range banners {
+		item := utils.Item{ID: b.ID, Title: b.Title, EndAt: b.EndAt}
+		for _, c := range b.Creatives {
+			item.Creatives = append(item.Creatives, c.Item())
+		}
+		if len(item.Creatives) != 0 {
+			item.Rotation = b.CreativeRotation
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (s *MemoryStore) NextBannerBoundary(p utils.PublicParams, now time.Time) (time.Time, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var banners []*Banner
+	for _, b := range s.banners {
+		if isServing(b) && b.Conditions().Matches(p) {
+			banners = append(banners, b)
+		}
+	}
+	next, ok := nextBoundary(banners, now)
+	return next, ok, nil
+}
+
+// the earliest start or end after now among the banners
+func nextBoundary(banners []*Banner, now time.Time) (time.Time, bool) {
+	var next time.Time
+	for _, b := range banners {
+		if !b.EndAt.After(now) {
+			continue
+		}
+
+		boundary := b.EndAt
+		if b.StartAt.After(now) {
+			boundary = b.StartAt
+		}
+		if next.IsZero() || boundary.Before(next) {
+			next = boundary
+		}
+	}
+	return next, !next.IsZero()
+}
+
+func (s *MemoryStore) NextScheduleChange(now time.Time) (time.Duration, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var schedules []BannerSchedule
+	for _, b := range s.banners {
+		if isServing(b) && !now.Before(b.StartAt) && !now.After(b.EndAt) {
+			schedules = append(schedules, b.Schedules...)
+		}
+	}
+	if len(schedules) == 0 {
+		return 0, false, nil
+	}
+	return nextScheduleChange(schedules, now), true, nil
+}
+
+func (s *MemoryStore) CrossedBanners(from, to time.Time) ([]Banner, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var banners []Banner
+	for _, b := range s.sorted() {
+		started := b.StartAt.After(from) && !b.StartAt.After(to)
+		ended := b.EndAt.After(from) && !b.EndAt.After(to)
+		if isServing(b) && (started || ended) {
+			banners = append(banners, b.clone())
+		}
+	}
+	return banners, nil
+}
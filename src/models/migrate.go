@@ -0,0 +1,275 @@
+package models
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// the sql of every schema change, one directory per dialect.
+// a migration is a pair of files named NNNN_name.up.sql and NNNN_name.down.sql
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// the migrations applied to a database, kept in the database itself
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// a migration and when it was applied, AppliedAt is nil while it is pending
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// the migrations for the dialect of db, ordered by version
+func Migrations(db *gorm.DB) ([]Migration, error) {
+	dir := path.Join("migrations", db.Dialector.Name())
+	files, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s: %w", db.Dialector.Name(), err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, f := range files {
+		base, direction := strings.TrimSuffix(f.Name(), ".sql"), ""
+		if strings.HasSuffix(base, ".up") {
+			base, direction = strings.TrimSuffix(base, ".up"), "up"
+		} else if strings.HasSuffix(base, ".down") {
+			base, direction = strings.TrimSuffix(base, ".down"), "down"
+		} else {
+			return nil, fmt.Errorf("migration %s is neither up nor down", f.Name())
+		}
+
+		prefix, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has no version", f.Name())
+		}
+
+		sql, err := migrationFiles.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(sql)
+		} else {
+			m.Down = string(sql)
+		}
+	}
+
+	var migrations []Migration
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// the table SchemaMigration is kept in, created before the first migration runs
+var schemaMigrationsTable = map[string]string{
+	"postgres": `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamptz NOT NULL
+	)`,
+	"sqlite": `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		applied_at datetime NOT NULL
+	)`,
+}
+
+// the columns later added to banners, which the baseline AutoMigrate created without them.
+// 0001 leaves an existing table as it is, so they are added to it first, see adoptBaseline
+var baselineBannerColumns = []struct {
+	name             string
+	postgres, sqlite string
+}{
+	{"status", "text DEFAULT 'active'", "text DEFAULT 'active'"},
+	{"priority", "bigint", "integer"},
+	{"weight", "bigint DEFAULT 1", "integer DEFAULT 1"},
+	{"cap_hourly", "bigint", "integer"},
+	{"cap_daily", "bigint", "integer"},
+	{"cap_lifetime", "bigint", "integer"},
+	{"daily_budget", "bigint", "integer"},
+	{"lifetime_budget", "bigint", "integer"},
+	{"creative_rotation", "text DEFAULT 'even'", "text DEFAULT 'even'"},
+}
+
+// brings a banners table created by the baseline AutoMigrate up to the one 0001 creates,
+// sqlite has no ADD COLUMN IF NOT EXISTS so the columns are checked one by one
+func adoptBaseline(tx *gorm.DB) error {
+	if !tx.Migrator().HasTable("banners") {
+		return nil
+	}
+	for _, c := range baselineBannerColumns {
+		if tx.Migrator().HasColumn("banners", c.name) {
+			continue
+		}
+		definition := c.postgres
+		if tx.Dialector.Name() == "sqlite" {
+			definition = c.sqlite
+		}
+		if err := tx.Exec("ALTER TABLE banners ADD COLUMN " + c.name + " " + definition).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// key of the postgres advisory lock held while migrating
+const migrationLockKey = 7302441226
+
+// runs migrate on one connection holding the migration lock, so instances booting together
+// apply each migration once. sqlite databases are not shared between instances and skip the lock
+func withMigrationLock(db *gorm.DB, migrate func(conn *gorm.DB) error) error {
+	if db.Dialector.Name() != "postgres" {
+		return migrate(db)
+	}
+
+	// the lock belongs to the session, so everything runs on the connection that took it
+	return db.Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("SELECT pg_advisory_lock(?)", migrationLockKey).Error; err != nil {
+			return err
+		}
+		defer func() {
+			if err := conn.Exec("SELECT pg_advisory_unlock(?)", migrationLockKey).Error; err != nil {
+				fmt.Println(err)
+			}
+		}()
+		return migrate(conn)
+	})
+}
+
+// every migration of the dialect with the time it was applied
+func MigrationStatus(db *gorm.DB) ([]MigrationState, error) {
+	migrations, err := Migrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	table, ok := schemaMigrationsTable[db.Dialector.Name()]
+	if !ok {
+		return nil, fmt.Errorf("no migrations for %s", db.Dialector.Name())
+	}
+	if err := db.Exec(table).Error; err != nil {
+		return nil, err
+	}
+	var applied []SchemaMigration
+	if err := db.Find(&applied).Error; err != nil {
+		return nil, err
+	}
+	appliedAt := map[int]time.Time{}
+	for _, a := range applied {
+		appliedAt[a.Version] = a.AppliedAt
+	}
+
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		states[i].Migration = m
+		if at, ok := appliedAt[m.Version]; ok {
+			states[i].AppliedAt = &at
+		}
+	}
+	return states, nil
+}
+
+// applies the pending migrations in order, each in its own transaction
+func MigrateUp(db *gorm.DB) ([]Migration, error) {
+	var applied []Migration
+	err := withMigrationLock(db, func(conn *gorm.DB) error {
+		states, err := MigrationStatus(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range states {
+			if s.AppliedAt != nil {
+				continue
+			}
+
+			err := conn.Transaction(func(tx *gorm.DB) error {
+				if s.Version == 1 {
+					if err := adoptBaseline(tx); err != nil {
+						return err
+					}
+				}
+				if err := tx.Exec(s.Up).Error; err != nil {
+					return err
+				}
+				return tx.Create(&SchemaMigration{Version: s.Version, Name: s.Name, AppliedAt: time.Now()}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", s.Version, s.Name, err)
+			}
+			applied = append(applied, s.Migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// rolls back the last steps applied migrations, newest first
+func MigrateDown(db *gorm.DB, steps int) ([]Migration, error) {
+	if steps < 1 {
+		return nil, errors.New("steps must be at least 1")
+	}
+
+	var reverted []Migration
+	err := withMigrationLock(db, func(conn *gorm.DB) error {
+		states, err := MigrationStatus(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(states) - 1; i >= 0 && len(reverted) < steps; i-- {
+			s := states[i]
+			if s.AppliedAt == nil {
+				continue
+			}
+
+			err := conn.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Exec(s.Down).Error; err != nil {
+					return err
+				}
+				return tx.Delete(&SchemaMigration{}, s.Version).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", s.Version, s.Name, err)
+			}
+			reverted = append(reverted, s.Migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
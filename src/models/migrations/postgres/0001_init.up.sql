@@ -0,0 +1,139 @@
+-- the schema AutoMigrate used to create. an existing banners table from the baseline is missing the
+-- later columns, MigrateUp adds them before this runs (see adoptBaseline)
+CREATE TABLE IF NOT EXISTS banners (
+    id bigserial PRIMARY KEY,
+    title text,
+    status text DEFAULT 'active',
+    priority bigint,
+    weight bigint DEFAULT 1,
+    cap_hourly bigint,
+    cap_daily bigint,
+    cap_lifetime bigint,
+    daily_budget bigint,
+    lifetime_budget bigint,
+    start_at timestamptz,
+    end_at timestamptz,
+    age_start bigint,
+    age_end bigint,
+    creative_rotation text DEFAULT 'even'
+);
+CREATE INDEX IF NOT EXISTS idx_banners_status ON banners (status);
+
+CREATE TABLE IF NOT EXISTS genders (
+    id bigserial PRIMARY KEY,
+    name text,
+    CONSTRAINT uni_genders_name UNIQUE (name)
+);
+
+CREATE TABLE IF NOT EXISTS countries (
+    id bigserial PRIMARY KEY,
+    name text,
+    CONSTRAINT uni_countries_name UNIQUE (name)
+);
+
+CREATE TABLE IF NOT EXISTS platforms (
+    id bigserial PRIMARY KEY,
+    name text,
+    CONSTRAINT uni_platforms_name UNIQUE (name)
+);
+
+CREATE TABLE IF NOT EXISTS banner_gender (
+    banner_id bigint,
+    gender_id bigint,
+    PRIMARY KEY (banner_id, gender_id),
+    CONSTRAINT fk_banner_gender_banner FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT fk_banner_gender_gender FOREIGN KEY (gender_id) REFERENCES genders (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS banner_country (
+    banner_id bigint,
+    country_id bigint,
+    PRIMARY KEY (banner_id, country_id),
+    CONSTRAINT fk_banner_country_banner FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT fk_banner_country_country FOREIGN KEY (country_id) REFERENCES countries (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS banner_platform (
+    banner_id bigint,
+    platform_id bigint,
+    PRIMARY KEY (banner_id, platform_id),
+    CONSTRAINT fk_banner_platform_banner FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT fk_banner_platform_platform FOREIGN KEY (platform_id) REFERENCES platforms (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS banner_excluded_gender (
+    banner_id bigint,
+    gender_id bigint,
+    PRIMARY KEY (banner_id, gender_id),
+    CONSTRAINT fk_banner_excluded_gender_banner FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT fk_banner_excluded_gender_gender FOREIGN KEY (gender_id) REFERENCES genders (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS banner_excluded_country (
+    banner_id bigint,
+    country_id bigint,
+    PRIMARY KEY (banner_id, country_id),
+    CONSTRAINT fk_banner_excluded_country_banner FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT fk_banner_excluded_country_country FOREIGN KEY (country_id) REFERENCES countries (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS banner_excluded_platform (
+    banner_id bigint,
+    platform_id bigint,
+    PRIMARY KEY (banner_id, platform_id),
+    CONSTRAINT fk_banner_excluded_platform_banner FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT fk_banner_excluded_platform_platform FOREIGN KEY (platform_id) REFERENCES platforms (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS banner_schedules (
+    id bigserial PRIMARY KEY,
+    banner_id bigint,
+    days bigint,
+    start_minute bigint,
+    end_minute bigint,
+    CONSTRAINT fk_banners_schedules FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_banner_schedules_banner_id ON banner_schedules (banner_id);
+
+CREATE TABLE IF NOT EXISTS creatives (
+    id bigserial PRIMARY KEY,
+    banner_id bigint,
+    image_url text,
+    link_url text,
+    cta_text text,
+    width bigint,
+    height bigint,
+    alt_text text,
+    weight bigint DEFAULT 1,
+    CONSTRAINT fk_banners_creatives FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_creatives_banner_id ON creatives (banner_id);
+
+CREATE TABLE IF NOT EXISTS experiments (
+    id bigserial PRIMARY KEY,
+    banner_id bigint,
+    status text DEFAULT 'running',
+    winner_variant_id bigint
+);
+CREATE INDEX IF NOT EXISTS idx_experiments_banner_id ON experiments (banner_id);
+
+CREATE TABLE IF NOT EXISTS variants (
+    id bigserial PRIMARY KEY,
+    experiment_id bigint,
+    name text,
+    title text,
+    creative_id bigint,
+    weight bigint DEFAULT 1,
+    exposures bigint,
+    clicks bigint,
+    CONSTRAINT fk_experiments_variants FOREIGN KEY (experiment_id) REFERENCES experiments (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_variants_experiment_id ON variants (experiment_id);
+
+CREATE TABLE IF NOT EXISTS banner_stats (
+    banner_id bigint,
+    day date,
+    impressions bigint,
+    clicks bigint,
+    PRIMARY KEY (banner_id, day)
+);
@@ -0,0 +1,10 @@
+-- the search filters banners by their time range first
+CREATE INDEX IF NOT EXISTS idx_banners_start_at_end_at ON banners (start_at, end_at);
+
+-- the primary keys of the join tables start with banner_id, these serve the lookups from a condition to its banners
+CREATE INDEX IF NOT EXISTS idx_banner_gender_gender_id ON banner_gender (gender_id, banner_id);
+CREATE INDEX IF NOT EXISTS idx_banner_country_country_id ON banner_country (country_id, banner_id);
+CREATE INDEX IF NOT EXISTS idx_banner_platform_platform_id ON banner_platform (platform_id, banner_id);
+CREATE INDEX IF NOT EXISTS idx_banner_excluded_gender_gender_id ON banner_excluded_gender (gender_id, banner_id);
+CREATE INDEX IF NOT EXISTS idx_banner_excluded_country_country_id ON banner_excluded_country (country_id, banner_id);
+CREATE INDEX IF NOT EXISTS idx_banner_excluded_platform_platform_id ON banner_excluded_platform (platform_id, banner_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS banner_revisions;
+DROP FUNCTION IF EXISTS banner_revisions_immutable();
@@ -0,0 +1,21 @@
+-- no foreign key to banners, the history of a banner outlives it
+CREATE TABLE banner_revisions (
+    id bigserial PRIMARY KEY,
+    banner_id bigint NOT NULL,
+    action text NOT NULL,
+    actor text,
+    before text,
+    after text,
+    restored_from bigint,
+    created_at timestamptz
+);
+CREATE INDEX idx_banner_revisions_banner_id ON banner_revisions (banner_id, id);
+
+CREATE FUNCTION banner_revisions_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'banner revisions are immutable';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER banner_revisions_immutable BEFORE UPDATE OR DELETE ON banner_revisions
+    FOR EACH ROW EXECUTE FUNCTION banner_revisions_immutable();
@@ -0,0 +1,15 @@
+DROP TABLE IF EXISTS banner_stats;
+DROP TABLE IF EXISTS variants;
+DROP TABLE IF EXISTS experiments;
+DROP TABLE IF EXISTS creatives;
+DROP TABLE IF EXISTS banner_schedules;
+DROP TABLE IF EXISTS banner_excluded_platform;
+DROP TABLE IF EXISTS banner_excluded_country;
+DROP TABLE IF EXISTS banner_excluded_gender;
+DROP TABLE IF EXISTS banner_platform;
+DROP TABLE IF EXISTS banner_country;
+DROP TABLE IF EXISTS banner_gender;
+DROP TABLE IF EXISTS platforms;
+DROP TABLE IF EXISTS countries;
+DROP TABLE IF EXISTS genders;
+DROP TABLE IF EXISTS banners;
@@ -0,0 +1,139 @@
+-- the schema AutoMigrate used to create. an existing banners table from the baseline is missing the
+-- later columns, MigrateUp adds them before this runs (see adoptBaseline)
+CREATE TABLE IF NOT EXISTS banners (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    title text,
+    status text DEFAULT 'active',
+    priority integer,
+    weight integer DEFAULT 1,
+    cap_hourly integer,
+    cap_daily integer,
+    cap_lifetime integer,
+    daily_budget integer,
+    lifetime_budget integer,
+    start_at datetime,
+    end_at datetime,
+    age_start integer,
+    age_end integer,
+    creative_rotation text DEFAULT 'even'
+);
+CREATE INDEX IF NOT EXISTS idx_banners_status ON banners (status);
+
+CREATE TABLE IF NOT EXISTS genders (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    name text,
+    CONSTRAINT uni_genders_name UNIQUE (name)
+);
+
+CREATE TABLE IF NOT EXISTS countries (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    name text,
+    CONSTRAINT uni_countries_name UNIQUE (name)
+);
+
+CREATE TABLE IF NOT EXISTS platforms (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    name text,
+    CONSTRAINT uni_platforms_name UNIQUE (name)
+);
+
+CREATE TABLE IF NOT EXISTS banner_gender (
+    banner_id integer,
+    gender_id integer,
+    PRIMARY KEY (banner_id, gender_id),
+    CONSTRAINT fk_banner_gender_banner FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT fk_banner_gender_gender FOREIGN KEY (gender_id) REFERENCES genders (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS banner_country (
+    banner_id integer,
+    country_id integer,
+    PRIMARY KEY (banner_id, country_id),
+    CONSTRAINT fk_banner_country_banner FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT fk_banner_country_country FOREIGN KEY (country_id) REFERENCES countries (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS banner_platform (
+    banner_id integer,
+    platform_id integer,
+    PRIMARY KEY (banner_id, platform_id),
+    CONSTRAINT fk_banner_platform_banner FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT fk_banner_platform_platform FOREIGN KEY (platform_id) REFERENCES platforms (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS banner_excluded_gender (
+    banner_id integer,
+    gender_id integer,
+    PRIMARY KEY (banner_id, gender_id),
+    CONSTRAINT fk_banner_excluded_gender_banner FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT fk_banner_excluded_gender_gender FOREIGN KEY (gender_id) REFERENCES genders (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS banner_excluded_country (
+    banner_id integer,
+    country_id integer,
+    PRIMARY KEY (banner_id, country_id),
+    CONSTRAINT fk_banner_excluded_country_banner FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT fk_banner_excluded_country_country FOREIGN KEY (country_id) REFERENCES countries (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS banner_excluded_platform (
+    banner_id integer,
+    platform_id integer,
+    PRIMARY KEY (banner_id, platform_id),
+    CONSTRAINT fk_banner_excluded_platform_banner FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT fk_banner_excluded_platform_platform FOREIGN KEY (platform_id) REFERENCES platforms (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS banner_schedules (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    banner_id integer,
+    days integer,
+    start_minute integer,
+    end_minute integer,
+    CONSTRAINT fk_banners_schedules FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_banner_schedules_banner_id ON banner_schedules (banner_id);
+
+CREATE TABLE IF NOT EXISTS creatives (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    banner_id integer,
+    image_url text,
+    link_url text,
+    cta_text text,
+    width integer,
+    height integer,
+    alt_text text,
+    weight integer DEFAULT 1,
+    CONSTRAINT fk_banners_creatives FOREIGN KEY (banner_id) REFERENCES banners (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_creatives_banner_id ON creatives (banner_id);
+
+CREATE TABLE IF NOT EXISTS experiments (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    banner_id integer,
+    status text DEFAULT 'running',
+    winner_variant_id integer
+);
+CREATE INDEX IF NOT EXISTS idx_experiments_banner_id ON experiments (banner_id);
+
+CREATE TABLE IF NOT EXISTS variants (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    experiment_id integer,
+    name text,
+    title text,
+    creative_id integer,
+    weight integer DEFAULT 1,
+    exposures integer,
+    clicks integer,
+    CONSTRAINT fk_experiments_variants FOREIGN KEY (experiment_id) REFERENCES experiments (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_variants_experiment_id ON variants (experiment_id);
+
+CREATE TABLE IF NOT EXISTS banner_stats (
+    banner_id integer,
+    day date,
+    impressions integer,
+    clicks integer,
+    PRIMARY KEY (banner_id, day)
+);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_banner_excluded_platform_platform_id;
+DROP INDEX IF EXISTS idx_banner_excluded_country_country_id;
+DROP INDEX IF EXISTS idx_banner_excluded_gender_gender_id;
+DROP INDEX IF EXISTS idx_banner_platform_platform_id;
+DROP INDEX IF EXISTS idx_banner_country_country_id;
+DROP INDEX IF EXISTS idx_banner_gender_gender_id;
+DROP INDEX IF EXISTS idx_banners_start_at_end_at;
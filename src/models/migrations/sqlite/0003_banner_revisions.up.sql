@@ -0,0 +1,22 @@
+-- no foreign key to banners, the history of a banner outlives it
+CREATE TABLE banner_revisions (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    banner_id integer NOT NULL,
+    action text NOT NULL,
+    actor text,
+    before text,
+    after text,
+    restored_from integer,
+    created_at datetime
+);
+CREATE INDEX idx_banner_revisions_banner_id ON banner_revisions (banner_id, id);
+
+CREATE TRIGGER banner_revisions_no_update BEFORE UPDATE ON banner_revisions
+BEGIN
+    SELECT RAISE(ABORT, 'banner revisions are immutable');
+END;
+
+CREATE TRIGGER banner_revisions_no_delete BEFORE DELETE ON banner_revisions
+BEGIN
+    SELECT RAISE(ABORT, 'banner revisions are immutable');
+END;
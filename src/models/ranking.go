@@ -0,0 +1,62 @@
+package models
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// ranking strategies of the public search
+const (
+	RankEndAt    = "end_at"   // soonest ending first
+	RankPriority = "priority" // highest priority first, end_at breaks ties
+	RankWeighted = "weighted" // random order, banners with higher weight tend to come first
+)
+
+func IsValidRank(rank string) bool {
+	return rank == RankEndAt || rank == RankPriority || rank == RankWeighted
+}
+
+func rankOrder(rank string) string {
+	if rank == RankEndAt {
+		return "end_at asc"
+	}
+	return "priority desc, end_at asc"
+}
+
+// sorts banners held in memory the way rankOrder sorts them in the database,
+// banners are expected in id order so ties keep it
+func rankBanners(banners []Banner, rank string) {
+	switch rank {
+	case RankWeighted:
+		weightedShuffle(banners)
+	case RankEndAt:
+		sort.SliceStable(banners, func(i, j int) bool {
+			return banners[i].EndAt.Before(banners[j].EndAt)
+		})
+	default:
+		sort.SliceStable(banners, func(i, j int) bool {
+			if banners[i].Priority != banners[j].Priority {
+				return banners[i].Priority > banners[j].Priority
+			}
+			return banners[i].EndAt.Before(banners[j].EndAt)
+		})
+	}
+}
+
+// weighted random sampling without replacement (Efraimidis-Spirakis),
+// each banner gets the key u^(1/weight) and the banners are sorted by it
+func weightedShuffle(banners []Banner) {
+	keys := make(map[uint]float64, len(banners))
+	for _, b := range banners {
+		weight := b.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		keys[b.ID] = math.Pow(rand.Float64(), 1/float64(weight))
+	}
+
+	sort.SliceStable(banners, func(i, j int) bool {
+		return keys[banners[i].ID] > keys[banners[j].ID]
+	})
+}
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"main/utils"
+	"reflect"
+	"time"
+)
+
+var (
+	ErrRevisionNotFound = errors.New("revision not found")
+	ErrNothingToRestore = errors.New("revision has no banner to restore")
+)
+
+// what a revision did to its banner
+const (
+	RevisionCreate  = "create"
+	RevisionUpdate  = "update"
+	RevisionStatus  = "status"
+	RevisionDelete  = "delete"
+	RevisionRestore = "restore"
+)
+
+// one change of a banner, written with the change and never updated or deleted, also not when
+// the banner is. Before and After are the banner's AdminParams as JSON, empty when it did not exist
+type BannerRevision struct {
+	ID       uint
+	BannerID uint `gorm:"index"`
+	Action   string
+	Actor    string
+	Before   string
+	After    string
+	// the revision a restore went back to
+	RestoredFrom uint
+	CreatedAt    time.Time
+}
+
+// the banner's fields, conditions and schedules as JSON, creatives are not part of the history
+func snapshot(b *Banner) string {
+	if b == nil {
+		return ""
+	}
+	data, _ := json.Marshal(b.Detail().AdminParams)
+	return string(data)
+}
+
+func newRevision(actor, action string, id uint, before, after *Banner) *BannerRevision {
+	return &BannerRevision{
+		BannerID:  id,
+		Action:    action,
+		Actor:     actor,
+		Before:    snapshot(before),
+		After:     snapshot(after),
+		CreatedAt: time.Now(),
+	}
+}
+
+// the banner as the revision left it, what a restore goes back to
+func (r *BannerRevision) State() (utils.AdminParams, error) {
+	var p utils.AdminParams
+	if r.After == "" {
+		return p, ErrNothingToRestore
+	}
+	err := json.Unmarshal([]byte(r.After), &p)
+	return p, err
+}
+
+func (r *BannerRevision) Detail() utils.RevisionDetail {
+	detail := utils.RevisionDetail{
+		ID:           r.ID,
+		BannerID:     r.BannerID,
+		Action:       r.Action,
+		Actor:        r.Actor,
+		CreatedAt:    r.CreatedAt,
+		RestoredFrom: r.RestoredFrom,
+		Changes:      diffSnapshots(r.Before, r.After),
+	}
+	if r.Before != "" {
+		detail.Before = &utils.AdminParams{}
+		json.Unmarshal([]byte(r.Before), detail.Before)
+	}
+	if r.After != "" {
+		detail.After = &utils.AdminParams{}
+		json.Unmarshal([]byte(r.After), detail.After)
+	}
+	return detail
+}
+
+// the fields that differ between two snapshots, nested fields are joined with dots like conditions.country
+func diffSnapshots(before, after string) map[string]utils.FieldChange {
+	flat := func(snapshot string) map[string]interface{} {
+		fields := map[string]interface{}{}
+		var doc map[string]interface{}
+		if snapshot != "" {
+			json.Unmarshal([]byte(snapshot), &doc)
+		}
+		flattenJSON("", doc, fields)
+		return fields
+	}
+	b, a := flat(before), flat(after)
+
+	changes := map[string]utils.FieldChange{}
+	for k, v := range b {
+		if !reflect.DeepEqual(v, a[k]) {
+			changes[k] = utils.FieldChange{Before: v, After: a[k]}
+		}
+	}
+	for k, v := range a {
+		if _, ok := b[k]; !ok {
+			changes[k] = utils.FieldChange{After: v}
+		}
+	}
+	return changes
+}
+
+func flattenJSON(prefix string, doc map[string]interface{}, fields map[string]interface{}) {
+	for k, v := range doc {
+		if prefix != "" {
+			k = prefix + "." + k
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			flattenJSON(k, nested, fields)
+		} else {
+			fields[k] = v
+		}
+	}
+}
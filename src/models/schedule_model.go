@@ -0,0 +1,149 @@
+package models
+
+import (
+	"main/utils"
+	"strings"
+	"time"
+)
+
+// a recurring window the banner is shown in, evaluated in the viewer's time zone.
+// a banner without schedules is shown for its whole StartAt-EndAt range
+type BannerSchedule struct {
+	ID       uint
+	BannerID uint `gorm:"index"`
+	// bit i is set when the window opens on time.Weekday(i)
+	Days int
+	// minutes since midnight, a window with StartMinute >= EndMinute runs past midnight into the next day
+	StartMinute int
+	EndMinute   int
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func ParseWeekday(name string) (time.Weekday, bool) {
+	for i, n := range weekdayNames {
+		if n == strings.ToLower(name) {
+			return time.Weekday(i), true
+		}
+	}
+	return 0, false
+}
+
+// parses "HH:MM" into minutes since midnight, "24:00" is accepted as the end of the day
+func ParseClock(clock string) (int, bool) {
+	t, err := time.Parse("15:04", clock)
+	if err == nil {
+		return t.Hour()*60 + t.Minute(), true
+	}
+	if clock == "24:00" {
+		return 24 * 60, true
+	}
+	return 0, false
+}
+
+func formatClock(minute int) string {
+	return time.Date(0, 1, 1, 0, minute, 0, 0, time.UTC).Format("15:04")
+}
+
+func toSchedules(params []utils.ScheduleParams) []BannerSchedule {
+	var schedules []BannerSchedule
+	for _, p := range params {
+		s := BannerSchedule{}
+		for _, d := range p.Days {
+			if day, ok := ParseWeekday(d); ok {
+				s.Days |= 1 << uint(day)
+			}
+		}
+		s.StartMinute, _ = ParseClock(p.Start)
+		s.EndMinute, _ = ParseClock(p.End)
+		schedules = append(schedules, s)
+	}
+	return schedules
+}
+
+func scheduleParams(schedules []BannerSchedule) []utils.ScheduleParams {
+	params := []utils.ScheduleParams{}
+	for _, s := range schedules {
+		p := utils.ScheduleParams{Days: []string{}, Start: formatClock(s.StartMinute), End: formatClock(s.EndMinute)}
+		if s.EndMinute == 24*60 {
+			p.End = "24:00"
+		}
+		for i, n := range weekdayNames {
+			if s.Days&(1<<uint(i)) != 0 {
+				p.Days = append(p.Days, n)
+			}
+		}
+		params = append(params, p)
+	}
+	return params
+}
+
+// sql matching the banners that are either unscheduled or inside one of their windows at now
+func scheduleQuery(now time.Time) (string, []interface{}) {
+	today := 1 << uint(now.Weekday())
+	yesterday := 1 << uint((now.Weekday()+6)%7)
+	minute := now.Hour()*60 + now.Minute()
+
+	query := `(NOT EXISTS (SELECT 1 FROM banner_schedules WHERE banner_schedules.banner_id = banners.id) OR EXISTS (
+		SELECT 1 FROM banner_schedules s WHERE s.banner_id = banners.id AND (
+			(s.start_minute < s.end_minute AND (s.days & ?) <> 0 AND ? >= s.start_minute AND ? < s.end_minute) OR
+			(s.start_minute >= s.end_minute AND (((s.days & ?) <> 0 AND ? >= s.start_minute) OR ((s.days & ?) <> 0 AND ? < s.end_minute)))
+		)))`
+	return query, []interface{}{today, minute, minute, today, minute, yesterday, minute}
+}
+
+// same as scheduleQuery, for banners held in memory
+func scheduledAt(schedules []BannerSchedule, now time.Time) bool {
+	if len(schedules) == 0 {
+		return true
+	}
+
+	today := 1 << uint(now.Weekday())
+	yesterday := 1 << uint((now.Weekday()+6)%7)
+	minute := now.Hour()*60 + now.Minute()
+
+	for _, s := range schedules {
+		if s.StartMinute < s.EndMinute {
+			if s.Days&today != 0 && minute >= s.StartMinute && minute < s.EndMinute {
+				return true
+			}
+		} else if s.Days&today != 0 && minute >= s.StartMinute || s.Days&yesterday != 0 && minute < s.EndMinute {
+			return true
+		}
+	}
+	return false
+}
+
+// the schedule boundary closest after now
+func nextScheduleChange(schedules []BannerSchedule, now time.Time) time.Duration {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	next := time.Duration(-1)
+	for _, s := range schedules {
+		for _, minute := range []int{s.StartMinute, s.EndMinute} {
+			boundary := midnight.Add(time.Duration(minute) * time.Minute)
+			if !boundary.After(now) {
+				boundary = boundary.AddDate(0, 0, 1)
+			}
+			if d := boundary.Sub(now); next < 0 || d < next {
+				next = d
+			}
+		}
+	}
+	return next
+}
+
+// time left until any schedule of a servable banner opens or closes, so cached responses can expire with it.
+// false means no banner is scheduled
+func (s *GormStore) NextScheduleChange(now time.Time) (time.Duration, bool, error) {
+	var schedules []BannerSchedule
+	err := s.db.Model(&BannerSchedule{}).
+		Distinct("banner_schedules.start_minute, banner_schedules.end_minute").
+		Joins("JOIN banners ON banners.id = banner_schedules.banner_id").
+		Where("? BETWEEN banners.start_at AND banners.end_at AND banners.status IN ?", now, servingStatuses).
+		Find(&schedules).Error
+	if err != nil || len(schedules) == 0 {
+		return 0, false, err
+	}
+
+	return nextScheduleChange(schedules, now), true, nil
+}
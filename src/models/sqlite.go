@@ -0,0 +1,80 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"time"
+
+	sqlitedriver "github.com/glebarez/go-sqlite"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// sqlite keeps times as text and compares them as strings, which only orders them when
+// they are written with the same offset. every time is written in the local zone, like the
+// TimeZone of the postgres connection, so stored days also stay on their calendar date
+type localTimeConnector struct {
+	dsn string
+}
+
+// the parts of the sqlite connection passed through by localTimeConn
+type sqliteConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+}
+
+type localTimeConn struct {
+	sqliteConn
+}
+
+func (c localTimeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return localTimeConn{conn.(sqliteConn)}, nil
+}
+
+func (c localTimeConnector) Driver() driver.Driver {
+	return &sqlitedriver.Driver{}
+}
+
+func inLocal(args []driver.NamedValue) []driver.NamedValue {
+	for i, a := range args {
+		if t, ok := a.Value.(time.Time); ok {
+			args[i].Value = t.In(time.Local)
+		}
+	}
+	return args
+}
+
+func (c localTimeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.sqliteConn.ExecContext(ctx, query, inLocal(args))
+}
+
+func (c localTimeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.sqliteConn.QueryContext(ctx, query, inLocal(args))
+}
+
+// opens the sqlite database at path, ":memory:" keeps it in memory until the process exits
+func openSQLite(path string) gorm.Dialector {
+	if path == "" {
+		path = ":memory:"
+	}
+
+	// the conditions are deleted with their banner through the foreign keys, like on postgres
+	dsn := path
+	if !strings.Contains(dsn, "?") {
+		dsn += "?"
+	} else {
+		dsn += "&"
+	}
+	dsn += "_pragma=foreign_keys(1)"
+
+	return sqlite.Dialector{Conn: sql.OpenDB(localTimeConnector{dsn: dsn})}
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"main/utils"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// daily impressions and clicks of a banner
+type BannerStat struct {
+	BannerID    uint      `gorm:"primaryKey;autoIncrement:false"`
+	Day         time.Time `gorm:"primaryKey;type:date"`
+	Impressions int64
+	Clicks      int64
+}
+
+// adds the counts onto the stored ones, stats of banners that do not exist are dropped
+func (s *GormStore) AddStats(stats []BannerStat) error {
+	if len(stats) == 0 {
+		return nil
+	}
+
+	ids := []uint{}
+	for _, stat := range stats {
+		ids = append(ids, stat.BannerID)
+	}
+
+	var existing []uint
+	if err := s.db.Model(&Banner{}).Where("id IN ?", ids).Pluck("id", &existing).Error; err != nil {
+		return err
+	}
+
+	found := map[uint]bool{}
+	for _, id := range existing {
+		found[id] = true
+	}
+
+	rows := []BannerStat{}
+	for _, stat := range stats {
+		if found[stat.BannerID] {
+			rows = append(rows, stat)
+		}
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return s.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "banner_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"impressions": gorm.Expr("banner_stats.impressions + excluded.impressions"),
+			"clicks":      gorm.Expr("banner_stats.clicks + excluded.clicks"),
+		}),
+	}).Create(&rows).Error
+}
+
+func (s *GormStore) Report(p utils.ReportParams) ([]utils.ReportItem, error) {
+	var stats []BannerStat
+
+	tx := s.db.Model(&BannerStat{})
+	if p.BannerID != 0 {
+		tx = tx.Where("banner_id = ?", p.BannerID)
+	}
+	if !p.From.IsZero() {
+		tx = tx.Where("day >= ?", p.From)
+	}
+	if !p.To.IsZero() {
+		tx = tx.Where("day <= ?", p.To)
+	}
+
+	if err := tx.Order("banner_id asc, day asc").Find(&stats).Error; err != nil {
+		return nil, err
+	}
+	return reportItems(stats), nil
+}
+
+// the stats with their CTR, in the order given
+func reportItems(stats []BannerStat) []utils.ReportItem {
+	items := []utils.ReportItem{}
+	for _, s := range stats {
+		item := utils.ReportItem{
+			BannerID:    s.BannerID,
+			Day:         s.Day.Format("2006-01-02"),
+			Impressions: s.Impressions,
+			Clicks:      s.Clicks,
+		}
+		if s.Impressions != 0 {
+			item.CTR = float64(s.Clicks) / float64(s.Impressions)
+		}
+		items = append(items, item)
+	}
+	return items
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"main/utils"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// where the banners are kept, the controllers only talk to banners through it.
+// every write to a banner records a BannerRevision by actor along with it
+type BannerStore interface {
+	CreateBanner(actor string, p utils.AdminParams) (uint, error)
+	GetBanner(id uint) (Banner, error)
+	ListBanners(p utils.ListParams) ([]Banner, int64, error)
+	UpdateBanner(actor string, id uint, p utils.AdminParams) error
+	TransitionBanner(actor string, id uint, to string) (Banner, error)
+	DeleteBanner(actor string, id uint) error
+	BannerHistory(id uint) ([]BannerRevision, error)
+	RestoreBanner(actor string, id, revisionID uint) (BannerRevision, error)
+	ListCreatives(bannerID uint) ([]Creative, error)
+	CreateCreative(bannerID uint, p utils.CreativeParams) (uint, error)
+	UpdateCreative(bannerID, id uint, p utils.CreativeParams) error
+	DeleteCreative(bannerID, id uint) error
+	SearchBanner(p utils.PublicParams, filters ...BannerFilter) ([]utils.Item, error)
+	// longest a write of another instance can be missing from SearchBanner, 0 when it shows up right away
+	MaxStaleness() time.Duration
+	NextBannerBoundary(p utils.PublicParams, now time.Time) (time.Time, bool, error)
+	NextScheduleChange(now time.Time) (time.Duration, bool, error)
+	CrossedBanners(from, to time.Time) ([]Banner, error)
+	CreateExperiment(p utils.ExperimentParams) (uint, error)
+	GetExperiment(id uint) (Experiment, error)
+	RunningExperiments(bannerIDs []uint) (map[uint]Experiment, error)
+	PromoteVariant(actor string, id, variantID uint, exposures, clicks map[uint]int64) (Experiment, error)
+	AddStats(stats []BannerStat) error
+	Report(p utils.ReportParams) ([]utils.ReportItem, error)
+}
+
+// keeps the banners in the database
+type GormStore struct {
+	db *gorm.DB
+}
+
+func NewGormStore(db *gorm.DB) *GormStore {
+	return &GormStore{db: db}
+}
@@ -3,19 +3,48 @@ package routers
 import (
 	"main/cache"
 	"main/controllers"
+	"main/models"
 
 	"github.com/gin-gonic/gin"
 )
 
-func Init() *gin.Engine {
+func Init(store models.BannerStore) *gin.Engine {
+	controllers.Store = store
 	router := gin.New()
+	// a panicking handler answers 500 instead of dropping the connection
+	router.Use(gin.Recovery())
 
 	api := router.Group("/api")
 	{
 		v1 := api.Group("/v1")
 		{
 			v1.POST("/ad", controllers.CreateBanner)
-			v1.GET("/ad", cache.CacheMiddleware(), controllers.SearchBanners)
+			v1.GET("/ad", cache.CacheMiddleware(controllers.CacheableParams, controllers.RefreshSearch), controllers.SearchBanners)
+			v1.GET("/ad/:id", controllers.GetBanner)
+			v1.PUT("/ad/:id", controllers.UpdateBanner)
+			v1.PATCH("/ad/:id", controllers.UpdateBanner)
+			v1.DELETE("/ad/:id", controllers.DeleteBanner)
+			v1.PUT("/ad/:id/status", controllers.TransitionBanner)
+			v1.GET("/ad/:id/creatives", controllers.ListCreatives)
+			v1.POST("/ad/:id/creatives", controllers.CreateCreative)
+			v1.PUT("/ad/:id/creatives/:creativeId", controllers.UpdateCreative)
+			v1.DELETE("/ad/:id/creatives/:creativeId", controllers.DeleteCreative)
+			v1.POST("/ad/:id/impression", controllers.TrackImpression)
+			v1.POST("/ad/:id/click", controllers.TrackClick)
+
+			admin := v1.Group("/admin")
+			{
+				admin.GET("/ad", controllers.ListBanners)
+				admin.GET("/ad/:id/history", controllers.BannerHistory)
+				admin.POST("/ad/:id/history/:revisionId/restore", controllers.RestoreBanner)
+				admin.GET("/report", controllers.Report)
+				admin.POST("/experiments", controllers.CreateExperiment)
+				admin.GET("/experiments/:id", controllers.GetExperiment)
+				admin.POST("/experiments/:id/promote", controllers.PromoteVariant)
+				admin.GET("/cache/metrics", controllers.GetCacheMetrics)
+				admin.POST("/cache/warm", controllers.WarmCache)
+				admin.POST("/cache/invalidate", controllers.InvalidateCache)
+			}
 		}
 	}
 
@@ -2,9 +2,11 @@ package api_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"main/cache"
+	"main/jobs"
 	"main/models"
 	"main/routers"
 	"main/tests/load_test"
@@ -12,9 +14,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redismock/v9"
 	"github.com/joho/godotenv"
@@ -22,6 +26,12 @@ import (
 )
 
 var testRouter *gin.Engine
+var testStore models.BannerStore
+
+// the mock data skips the api, so nothing evicts the responses cached for the previous data
+func dropCache() {
+	cache.DeleteMatchingCache(context.Background(), func(utils.PublicParams) bool { return true })
+}
 
 func prepareFilteringMockData() {
 	banners := []models.Banner{
@@ -35,6 +45,7 @@ func prepareFilteringMockData() {
 	for _, banner := range banners {
 		models.DB.Create(&banner)
 	}
+	dropCache()
 }
 
 func preparePaginationMockData() {
@@ -54,17 +65,34 @@ func preparePaginationMockData() {
 	for _, banner := range banners {
 		models.DB.Create(&banner)
 	}
+	dropCache()
 }
 
 func TestMain(m *testing.M) {
 	godotenv.Load("../../../.env")
 	os.Setenv("APP_ENV", "test")
 	fmt.Print(os.Getenv("APP_ENV"))
+
+	// without a configured test database and redis, run on an in-memory sqlite and an in-process redis
+	if os.Getenv("TEST_DB_DRIVER") == "" && os.Getenv("TEST_DB_HOST") == "" {
+		os.Setenv("TEST_DB_DRIVER", "sqlite")
+	}
+	if os.Getenv("TEST_REDIS_HOST") == "" && os.Getenv("TEST_REDIS_ADDRS") == "" {
+		server, err := miniredis.Run()
+		if err != nil {
+			panic(err)
+		}
+		defer server.Close()
+		os.Setenv("TEST_REDIS_HOST", server.Host())
+		os.Setenv("TEST_REDIS_PORT", server.Port())
+	}
+
 	models.Init()
 	cache.Init()
 	load_test.DeleteAllData()
 
-	testRouter = routers.Init()
+	testStore = models.NewGormStore(models.DB)
+	testRouter = routers.Init(testStore)
 	m.Run()
 }
 
@@ -177,6 +205,51 @@ func TestCreateBannerAPIClientError(t *testing.T) {
 			},
 			want: gin.H{"error": "Invalid platform"},
 		},
+		{
+			name: "Invalid excluded country",
+			body: utils.AdminParams{
+				Title:   "test banner",
+				StartAt: time.Now(),
+				EndAt:   time.Now().Add(time.Duration(2) * time.Hour),
+				Conditions: utils.ConditionParams{
+					ExcludeCountry: []string{"EVIL"},
+				},
+			},
+			want: gin.H{"error": "Invalid country"},
+		},
+		{
+			name: "Targeted and excluded",
+			body: utils.AdminParams{
+				Title:   "test banner",
+				StartAt: time.Now(),
+				EndAt:   time.Now().Add(time.Duration(2) * time.Hour),
+				Conditions: utils.ConditionParams{
+					Platform:        []string{"ios", "web"},
+					ExcludePlatform: []string{"web"},
+				},
+			},
+			want: gin.H{"error": "A condition cannot be both targeted and excluded"},
+		},
+		{
+			name: "Invalid schedule day",
+			body: utils.AdminParams{
+				Title:     "test banner",
+				StartAt:   time.Now(),
+				EndAt:     time.Now().Add(time.Duration(2) * time.Hour),
+				Schedules: []utils.ScheduleParams{{Days: []string{"mon", "someday"}, Start: "18:00", End: "23:00"}},
+			},
+			want: gin.H{"error": "Invalid schedule day"},
+		},
+		{
+			name: "Invalid schedule time",
+			body: utils.AdminParams{
+				Title:     "test banner",
+				StartAt:   time.Now(),
+				EndAt:     time.Now().Add(time.Duration(2) * time.Hour),
+				Schedules: []utils.ScheduleParams{{Days: []string{"mon"}, Start: "18:00", End: "25:00"}},
+			},
+			want: gin.H{"error": "Invalid schedule time"},
+		},
 	}
 
 	for _, tt := range tests {
@@ -300,6 +373,16 @@ func TestSearchBannersClientError(t *testing.T) {
 			url:  "/api/v1/ad?platform=X",
 			want: gin.H{"error": "Invalid platform"},
 		},
+		{
+			name: "Invalid rank",
+			url:  "/api/v1/ad?rank=X",
+			want: gin.H{"error": "Invalid rank"},
+		},
+		{
+			name: "Invalid tz",
+			url:  "/api/v1/ad?tz=Mars/Olympus",
+			want: gin.H{"error": "Invalid tz"},
+		},
 	}
 
 	for _, tt := range tests {
@@ -317,21 +400,962 @@ func TestSearchBannersClientError(t *testing.T) {
 	}
 }
 
+func createTestBanner(t *testing.T, adminParams utils.AdminParams) uint {
+	jsonData, _ := json.Marshal(adminParams)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/ad", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	testRouter.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+
+	var got struct {
+		ID uint `json:"id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &got)
+	return got.ID
+}
+
+func TestBannerCRUDAPI(t *testing.T) {
+	load_test.DeleteAllData()
+
+	id := createTestBanner(t, utils.AdminParams{
+		Title:   "crud banner",
+		StartAt: time.Now(),
+		EndAt:   time.Now().Add(2 * time.Hour),
+		Conditions: utils.ConditionParams{
+			AgeStart: 20,
+			AgeEnd:   30,
+			Country:  []string{"TW"},
+		},
+	})
+	url := fmt.Sprintf("/api/v1/ad/%d", id)
+
+	// Get
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", url, nil)
+	testRouter.ServeHTTP(w, req)
+
+	var got utils.BannerDetail
+	json.Unmarshal(w.Body.Bytes(), &got)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "crud banner", got.Title)
+	assert.DeepEqual(t, []string{"TW"}, got.Conditions.Country)
+
+	// Patch only touches the fields in the body
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PATCH", url, bytes.NewBufferString(`{"title": "patched", "conditions": {"platform": ["ios"]}}`))
+	req.Header.Set("Content-Type", "application/json")
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", url, nil)
+	testRouter.ServeHTTP(w, req)
+
+	got = utils.BannerDetail{}
+	json.Unmarshal(w.Body.Bytes(), &got)
+	assert.Equal(t, "patched", got.Title)
+	assert.Equal(t, 20, got.Conditions.AgeStart)
+	assert.DeepEqual(t, []string{"TW"}, got.Conditions.Country)
+	assert.DeepEqual(t, []string{"ios"}, got.Conditions.Platform)
+
+	// Put replaces everything
+	jsonData, _ := json.Marshal(utils.AdminParams{
+		Title:   "replaced",
+		StartAt: time.Now(),
+		EndAt:   time.Now().Add(3 * time.Hour),
+	})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", url, bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", url, nil)
+	testRouter.ServeHTTP(w, req)
+
+	got = utils.BannerDetail{}
+	json.Unmarshal(w.Body.Bytes(), &got)
+	assert.Equal(t, "replaced", got.Title)
+	assert.Equal(t, 0, got.Conditions.AgeStart)
+	assert.Equal(t, 0, len(got.Conditions.Country))
+	assert.Equal(t, 0, len(got.Conditions.Platform))
+
+	// List
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/admin/ad", nil)
+	testRouter.ServeHTTP(w, req)
+
+	var list utils.BannerList
+	json.Unmarshal(w.Body.Bytes(), &list)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, int64(1), list.Total)
+	assert.Equal(t, id, list.Data[0].ID)
+
+	// Delete
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", url, nil)
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", url, nil)
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestBannerCRUDAPIClientError(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+		code   int
+		want   gin.H
+	}{
+		{
+			name:   "Invalid id",
+			method: "GET",
+			url:    "/api/v1/ad/abc",
+			code:   400,
+			want:   gin.H{"error": "Invalid id"},
+		},
+		{
+			name:   "Get not found",
+			method: "GET",
+			url:    "/api/v1/ad/999999",
+			code:   404,
+			want:   gin.H{"error": "Banner not found"},
+		},
+		{
+			name:   "Patch not found",
+			method: "PATCH",
+			url:    "/api/v1/ad/999999",
+			body:   `{"title": "x"}`,
+			code:   404,
+			want:   gin.H{"error": "Banner not found"},
+		},
+		{
+			name:   "Delete not found",
+			method: "DELETE",
+			url:    "/api/v1/ad/999999",
+			code:   404,
+			want:   gin.H{"error": "Banner not found"},
+		},
+		{
+			name:   "Invalid pagination",
+			method: "GET",
+			url:    "/api/v1/admin/ad?limit=-1",
+			code:   400,
+			want:   gin.H{"error": "Invalid pagination"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tt.method, tt.url, bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			testRouter.ServeHTTP(w, req)
+
+			var got gin.H
+			json.Unmarshal(w.Body.Bytes(), &got)
+			assert.Equal(t, tt.code, w.Code)
+			assert.Equal(t, tt.want["error"], got["error"])
+		})
+	}
+}
+
+func TestTransitionBannerAPI(t *testing.T) {
+	load_test.DeleteAllData()
+
+	id := createTestBanner(t, utils.AdminParams{
+		Title:   "status banner",
+		StartAt: time.Now(),
+		EndAt:   time.Now().Add(2 * time.Hour),
+	})
+	url := fmt.Sprintf("/api/v1/ad/%d/status", id)
+
+	tests := []struct {
+		name   string
+		status string
+		code   int
+	}{
+		{name: "Pause", status: "paused", code: 200},
+		{name: "Resume", status: "active", code: 200},
+		{name: "Back to draft", status: "draft", code: 409},
+		{name: "Stop", status: "stopped", code: 200},
+		{name: "Resume stopped", status: "active", code: 409},
+		{name: "Unknown status", status: "deleted", code: 400},
+		{name: "Archive", status: "archived", code: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("PUT", url, bytes.NewBufferString(fmt.Sprintf(`{"status": "%s"}`, tt.status)))
+			req.Header.Set("Content-Type", "application/json")
+			testRouter.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.code, w.Code)
+		})
+	}
+
+	banner, _ := testStore.GetBanner(id)
+	assert.Equal(t, models.StatusArchived, banner.Status)
+
+	items, _ := testStore.SearchBanner(utils.PublicParams{Limit: 5})
+	assert.Equal(t, 0, len(items))
+}
+
+func TestBannerHistoryAPI(t *testing.T) {
+	load_test.DeleteAllData()
+	dropCache()
+
+	jsonData, _ := json.Marshal(utils.AdminParams{
+		Title:      "history banner",
+		StartAt:    time.Now(),
+		EndAt:      time.Now().Add(2 * time.Hour),
+		Conditions: utils.ConditionParams{Country: []string{"TW"}},
+	})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/ad", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Actor", "alice")
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	var created struct {
+		ID uint `json:"id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	search := func() int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/ad?country=TW&limit=5", nil)
+		testRouter.ServeHTTP(w, req)
+
+		var got []utils.Item
+		json.Unmarshal(w.Body.Bytes(), &got)
+		return len(got)
+	}
+	assert.Equal(t, 1, search())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PATCH", fmt.Sprintf("/api/v1/ad/%d", created.ID), bytes.NewBufferString(`{"conditions": {"country": ["US"]}}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Actor", "bob")
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 0, search())
+
+	history := func() utils.RevisionList {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/v1/admin/ad/%d/history", created.ID), nil)
+		testRouter.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+
+		var list utils.RevisionList
+		json.Unmarshal(w.Body.Bytes(), &list)
+		return list
+	}
+	list := history()
+	assert.Equal(t, 2, len(list.Data))
+	assert.Equal(t, "alice", list.Data[0].Actor)
+	assert.Equal(t, models.RevisionCreate, list.Data[0].Action)
+	assert.Equal(t, "bob", list.Data[1].Actor)
+	assert.DeepEqual(t, utils.FieldChange{Before: []interface{}{"TW"}, After: []interface{}{"US"}}, list.Data[1].Changes["conditions.country"])
+
+	// restoring the first revision brings the banner back into the cached search
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/api/v1/admin/ad/%d/history/%d/restore", created.ID, list.Data[0].ID), nil)
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 1, search())
+
+	list = history()
+	assert.Equal(t, 3, len(list.Data))
+	assert.Equal(t, models.RevisionRestore, list.Data[2].Action)
+	assert.Equal(t, "anonymous", list.Data[2].Actor)
+	assert.Equal(t, list.Data[0].ID, list.Data[2].RestoredFrom)
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		code   int
+	}{
+		{name: "Unknown banner", method: "GET", url: "/api/v1/admin/ad/999999/history", code: 404},
+		{name: "Invalid revision", method: "POST", url: fmt.Sprintf("/api/v1/admin/ad/%d/history/abc/restore", created.ID), code: 400},
+		{name: "Revision of another banner", method: "POST", url: fmt.Sprintf("/api/v1/admin/ad/%d/history/%d/restore", created.ID+1, list.Data[0].ID), code: 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tt.method, tt.url, nil)
+			testRouter.ServeHTTP(w, req)
+			assert.Equal(t, tt.code, w.Code)
+		})
+	}
+}
+
+func TestSearchBannersRank(t *testing.T) {
+	banners := []models.Banner{
+		{Title: "Low", StartAt: time.Now(), EndAt: time.Now().Add(1 * time.Hour), Priority: 1},
+		{Title: "High", StartAt: time.Now(), EndAt: time.Now().Add(3 * time.Hour), Priority: 10},
+		{Title: "HighSooner", StartAt: time.Now(), EndAt: time.Now().Add(2 * time.Hour), Priority: 10},
+	}
+	load_test.DeleteAllData()
+	for _, banner := range banners {
+		models.DB.Create(&banner)
+	}
+
+	tests := []struct {
+		name string
+		rank string
+		want []string
+	}{
+		{name: "Priority", rank: models.RankPriority, want: []string{"HighSooner", "High", "Low"}},
+		{name: "End at", rank: models.RankEndAt, want: []string{"Low", "HighSooner", "High"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := testStore.SearchBanner(utils.PublicParams{Limit: 5, Rank: tt.rank})
+			assert.NilError(t, err)
+			assert.Equal(t, len(tt.want), len(items))
+			for i, title := range tt.want {
+				assert.Equal(t, title, items[i].Title)
+			}
+		})
+	}
+
+	t.Run("Weighted", func(t *testing.T) {
+		items, err := testStore.SearchBanner(utils.PublicParams{Limit: 5, Rank: models.RankWeighted})
+		assert.NilError(t, err)
+		assert.Equal(t, 3, len(items))
+	})
+
+	// weighted requests skip the cache, they are neither looked up nor counted as misses
+	t.Run("Weighted API", func(t *testing.T) {
+		before := cache.Metrics()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/ad?rank=weighted", nil)
+		testRouter.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+
+		var items []utils.Item
+		json.Unmarshal(w.Body.Bytes(), &items)
+		assert.Equal(t, 3, len(items))
+		after := cache.Metrics()
+		assert.Equal(t, before.Misses, after.Misses)
+		assert.Equal(t, before.LocalHits+before.RedisHits, after.LocalHits+after.RedisHits)
+	})
+}
+
+func TestSearchBannersFrequencyCap(t *testing.T) {
+	banners := []models.Banner{
+		{Title: "Capped", StartAt: time.Now(), EndAt: time.Now().Add(1 * time.Hour), CapHourly: 1},
+		{Title: "Uncapped", StartAt: time.Now(), EndAt: time.Now().Add(2 * time.Hour)},
+	}
+	load_test.DeleteAllData()
+	for _, banner := range banners {
+		models.DB.Create(&banner)
+	}
+
+	userID := fmt.Sprintf("user-%d", time.Now().UnixNano())
+	wants := [][]string{{"Capped", "Uncapped"}, {"Uncapped"}}
+
+	for i, want := range wants {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/ad?userId="+userID, nil)
+		testRouter.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+
+		var got []utils.Item
+		json.Unmarshal(w.Body.Bytes(), &got)
+		assert.Equal(t, len(want), len(got), i)
+		for j, title := range want {
+			assert.Equal(t, title, got[j].Title)
+		}
+	}
+}
+
+func TestTrackingAndReportAPI(t *testing.T) {
+	load_test.DeleteAllData()
+	jobs.FlushStats(context.Background(), testStore)
+
+	id := createTestBanner(t, utils.AdminParams{
+		Title:   "tracked banner",
+		StartAt: time.Now(),
+		EndAt:   time.Now().Add(2 * time.Hour),
+	})
+
+	events := []string{"impression", "impression", "impression", "impression", "click"}
+	for _, event := range events {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/api/v1/ad/%d/%s", id, event), nil)
+		testRouter.ServeHTTP(w, req)
+		assert.Equal(t, 204, w.Code)
+	}
+
+	assert.NilError(t, jobs.FlushStats(context.Background(), testStore))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/v1/admin/report?bannerId=%d", id), nil)
+	testRouter.ServeHTTP(w, req)
+
+	var got []utils.ReportItem
+	json.Unmarshal(w.Body.Bytes(), &got)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 1, len(got))
+	assert.Equal(t, time.Now().Format("2006-01-02"), got[0].Day)
+	assert.Equal(t, int64(4), got[0].Impressions)
+	assert.Equal(t, int64(1), got[0].Clicks)
+	assert.Equal(t, 0.25, got[0].CTR)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/admin/report?from=2024-03-02&to=2024-03-01", nil)
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestSearchBannersBudget(t *testing.T) {
+	banners := []models.Banner{
+		{Title: "Budgeted", StartAt: time.Now(), EndAt: time.Now().Add(1 * time.Hour), LifetimeBudget: 100},
+		{Title: "Unbudgeted", StartAt: time.Now(), EndAt: time.Now().Add(2 * time.Hour)},
+	}
+	load_test.DeleteAllData()
+	for _, banner := range banners {
+		models.DB.Create(&banner)
+		// ids start over on a new sqlite database, drop what an earlier run spent under the same id
+		cache.RedisClient.Del(context.Background(), fmt.Sprintf("budget:{%d}:l", banner.ID))
+	}
+
+	// right after the start only one impression is within pace
+	wants := [][]string{{"Budgeted", "Unbudgeted"}, {"Unbudgeted"}}
+
+	for i, want := range wants {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/ad?platform=ios", nil)
+		testRouter.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+
+		var got []utils.Item
+		json.Unmarshal(w.Body.Bytes(), &got)
+		assert.Equal(t, len(want), len(got), i)
+		for j, title := range want {
+			assert.Equal(t, title, got[j].Title)
+		}
+	}
+}
+
+func TestIndexedStoreSearch(t *testing.T) {
+	prepareFilteringMockData()
+
+	index := models.NewIndexedStore(testStore)
+	assert.NilError(t, index.Load())
+
+	for _, p := range []utils.PublicParams{
+		{},
+		{Age: 20},
+		{Gender: "M"},
+		{Country: "US"},
+		{Platform: "android"},
+		{Age: 35, Gender: "F", Country: "TW", Platform: "web"},
+		{Rank: models.RankEndAt, Country: "JP"},
+	} {
+		want, err := testStore.SearchBanner(p)
+		assert.NilError(t, err)
+		got, err := index.SearchBanner(p)
+		assert.NilError(t, err)
+
+		assert.Equal(t, len(want), len(got), fmt.Sprintf("%+v", p))
+		for i := range want {
+			assert.Equal(t, want[i].ID, got[i].ID)
+		}
+	}
+}
+
+// two instances on the same database, a write through one reaches the other's index without waiting for a reload
+func TestIndexedStoreReplicas(t *testing.T) {
+	load_test.DeleteAllData()
+
+	writer := models.NewIndexedStore(testStore)
+	reader := models.NewIndexedStore(testStore)
+	for _, index := range []*models.IndexedStore{writer, reader} {
+		assert.NilError(t, index.Load())
+		jobs.StartIndexReloader(index)
+	}
+
+	now := time.Now()
+	_, err := writer.CreateBanner("alice", utils.AdminParams{Title: "replicated", StartAt: now.Add(-time.Minute), EndAt: now.Add(time.Hour)})
+	assert.NilError(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	var items []utils.Item
+	for time.Now().Before(deadline) {
+		items, err = reader.SearchBanner(utils.PublicParams{})
+		assert.NilError(t, err)
+		if len(items) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, len(items))
+	assert.Equal(t, "replicated", items[0].Title)
+}
+
+func TestSearchBannersExclusion(t *testing.T) {
+	banners := []models.Banner{
+		{Title: "NotCN", StartAt: time.Now(), EndAt: time.Now().Add(1 * time.Hour), ExcludedCountries: []models.Country{{Name: "CN"}}},
+		{Title: "NotWeb", StartAt: time.Now(), EndAt: time.Now().Add(2 * time.Hour), ExcludedPlatforms: []models.Platform{{Name: "web"}}},
+		{Title: "NotFemale", StartAt: time.Now(), EndAt: time.Now().Add(3 * time.Hour), ExcludedGenders: []models.Gender{{Name: "F"}}},
+	}
+	load_test.DeleteAllData()
+	for _, banner := range banners {
+		models.DB.Create(&banner)
+	}
+
+	tests := []struct {
+		name   string
+		params utils.PublicParams
+		want   []string
+	}{
+		{name: "Excluded country", params: utils.PublicParams{Country: "CN"}, want: []string{"NotWeb", "NotFemale"}},
+		{name: "Other country", params: utils.PublicParams{Country: "TW"}, want: []string{"NotCN", "NotWeb", "NotFemale"}},
+		{name: "Excluded platform", params: utils.PublicParams{Platform: "web"}, want: []string{"NotCN", "NotFemale"}},
+		{name: "Excluded gender", params: utils.PublicParams{Gender: "F", Platform: "web"}, want: []string{"NotCN"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.params.Limit = 5
+			items, err := testStore.SearchBanner(tt.params)
+			assert.NilError(t, err)
+			assert.Equal(t, len(tt.want), len(items))
+			for i, title := range tt.want {
+				assert.Equal(t, title, items[i].Title)
+			}
+		})
+	}
+}
+
+func TestSearchBannersSchedule(t *testing.T) {
+	load_test.DeleteAllData()
+
+	now := time.Now()
+	everyday := []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+	schedules := map[string][]utils.ScheduleParams{
+		"InWindow":  {{Days: everyday, Start: now.Add(-time.Hour).Format("15:04"), End: now.Add(time.Hour).Format("15:04")}},
+		"OutWindow": {{Days: everyday, Start: now.Add(time.Hour).Format("15:04"), End: now.Add(2 * time.Hour).Format("15:04")}},
+		"OtherDay":  {{Days: []string{strings.ToLower(now.Add(48 * time.Hour).Weekday().String()[:3])}, Start: "00:00", End: "24:00"}},
+	}
+
+	for title, schedule := range schedules {
+		createTestBanner(t, utils.AdminParams{
+			Title:     title,
+			StartAt:   now,
+			EndAt:     now.Add(3 * time.Hour),
+			Schedules: schedule,
+		})
+	}
+
+	items, err := testStore.SearchBanner(utils.PublicParams{Limit: 5})
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(items))
+	assert.Equal(t, "InWindow", items[0].Title)
+
+	next, ok, err := testStore.NextScheduleChange(now)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	assert.Assert(t, next <= time.Hour)
+}
+
+func TestCreativeAPI(t *testing.T) {
+	load_test.DeleteAllData()
+
+	id := createTestBanner(t, utils.AdminParams{
+		Title:   "creative banner",
+		StartAt: time.Now(),
+		EndAt:   time.Now().Add(2 * time.Hour),
+	})
+	url := fmt.Sprintf("/api/v1/ad/%d/creatives", id)
+
+	creativeIDs := []uint{}
+	for _, image := range []string{"https://img.example.com/a.png", "https://img.example.com/b.png"} {
+		jsonData, _ := json.Marshal(utils.CreativeParams{ImageURL: image, LinkURL: "https://example.com", CTAText: "Buy"})
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+		req.Header.Set("Content-Type", "application/json")
+		testRouter.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+
+		var got struct {
+			ID uint `json:"id"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &got)
+		creativeIDs = append(creativeIDs, got.ID)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", url, nil)
+	testRouter.ServeHTTP(w, req)
+
+	var creatives []utils.CreativeDetail
+	json.Unmarshal(w.Body.Bytes(), &creatives)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 2, len(creatives))
+
+	// the two creatives take turns, whether the response comes from the database or the cache
+	served := map[uint]bool{}
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/ad?platform=web&age=55", nil)
+		testRouter.ServeHTTP(w, req)
+
+		var got []utils.Item
+		json.Unmarshal(w.Body.Bytes(), &got)
+		assert.Equal(t, 1, len(got))
+		assert.Assert(t, got[0].Creative != nil)
+		assert.Equal(t, 0, len(got[0].Creatives))
+		served[got[0].Creative.ID] = true
+	}
+	assert.Equal(t, 2, len(served))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", url, bytes.NewBufferString(`{"imageUrl": "not a url", "linkUrl": "https://example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("%s/%d", url, creativeIDs[0]), nil)
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("%s/%d", url, creativeIDs[0]), nil)
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestExperimentAPI(t *testing.T) {
+	load_test.DeleteAllData()
+
+	id := createTestBanner(t, utils.AdminParams{
+		Title:   "original",
+		StartAt: time.Now(),
+		EndAt:   time.Now().Add(2 * time.Hour),
+	})
+
+	body, _ := json.Marshal(utils.ExperimentParams{
+		BannerID: id,
+		Variants: []utils.VariantParams{
+			{Name: "A", Title: "title A"},
+			{Name: "B", Title: "title B"},
+		},
+	})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/admin/experiments", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	var created struct {
+		ID uint `json:"id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	// a second running experiment on the same banner is refused
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/admin/experiments", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 409, w.Code)
+
+	// the same user always gets the same variant
+	userID := fmt.Sprintf("user-%d", time.Now().UnixNano())
+	var first []utils.Item
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/ad?userId="+userID, nil)
+		testRouter.ServeHTTP(w, req)
+
+		var got []utils.Item
+		json.Unmarshal(w.Body.Bytes(), &got)
+		assert.Equal(t, 1, len(got))
+		assert.Assert(t, got[0].VariantID != 0)
+		if first == nil {
+			first = got
+		}
+		assert.Equal(t, first[0].VariantID, got[0].VariantID)
+		assert.Equal(t, first[0].Title, got[0].Title)
+	}
+
+	url := fmt.Sprintf("/api/v1/admin/experiments/%d", created.ID)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", url, nil)
+	testRouter.ServeHTTP(w, req)
+
+	var detail utils.ExperimentDetail
+	json.Unmarshal(w.Body.Bytes(), &detail)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 2, len(detail.Variants))
+
+	// clicks only count for the variants of the banner's running experiment
+	for variantID, code := range map[uint]int{first[0].VariantID: 204, first[0].VariantID + 100: 400} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", fmt.Sprintf("/api/v1/ad/%d/click?variantId=%d", id, variantID), nil)
+		testRouter.ServeHTTP(w, req)
+		assert.Equal(t, code, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", url+"/promote", bytes.NewBufferString(fmt.Sprintf(`{"variantId": %d}`, first[0].VariantID)))
+	req.Header.Set("Content-Type", "application/json")
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	banner, _ := testStore.GetBanner(id)
+	assert.Equal(t, first[0].Title, banner.Title)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", url+"/promote", bytes.NewBufferString(fmt.Sprintf(`{"variantId": %d}`, first[0].VariantID)))
+	req.Header.Set("Content-Type", "application/json")
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 409, w.Code)
+}
+
+// experiments and reports work without a database too
+func TestMemoryStoreAPI(t *testing.T) {
+	store := models.NewMemoryStore()
+	router := routers.Init(store)
+	defer routers.Init(testStore)
+
+	serve := func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	jsonData, _ := json.Marshal(utils.AdminParams{Title: "memory", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)})
+	w := serve("POST", "/api/v1/ad", string(jsonData))
+	assert.Equal(t, 200, w.Code)
+	var created struct {
+		ID uint `json:"id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	w = serve("POST", "/api/v1/admin/experiments", fmt.Sprintf(`{"bannerId": %d, "variants": [{"name": "A", "title": "title A"}, {"name": "B", "title": "title B"}]}`, created.ID))
+	assert.Equal(t, 200, w.Code)
+	var experiment struct {
+		ID uint `json:"id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &experiment)
+
+	w = serve("GET", "/api/v1/ad?userId=u1", "")
+	assert.Equal(t, 200, w.Code)
+	var items []utils.Item
+	json.Unmarshal(w.Body.Bytes(), &items)
+	assert.Equal(t, 1, len(items))
+	assert.Assert(t, items[0].VariantID != 0)
+
+	w = serve("POST", fmt.Sprintf("/api/v1/admin/experiments/%d/promote", experiment.ID), fmt.Sprintf(`{"variantId": %d}`, items[0].VariantID))
+	assert.Equal(t, 200, w.Code)
+	banner, _ := store.GetBanner(created.ID)
+	assert.Equal(t, items[0].Title, banner.Title)
+
+	w = serve("POST", fmt.Sprintf("/api/v1/ad/%d/impression", created.ID), "")
+	assert.Equal(t, 204, w.Code)
+	assert.NilError(t, jobs.FlushStats(context.Background(), store))
+
+	w = serve("GET", fmt.Sprintf("/api/v1/admin/report?bannerId=%d", created.ID), "")
+	assert.Equal(t, 200, w.Code)
+	var report []utils.ReportItem
+	json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Equal(t, 1, len(report))
+	assert.Assert(t, report[0].Impressions >= 1)
+}
+
+func TestSearchBannersBoundaryTTL(t *testing.T) {
+	load_test.DeleteAllData()
+
+	os.Setenv("AD_RANK", "")
+	key := cache.VersionedKey("/api/v1/ad?country=TW&rank=priority", utils.PublicParams{Country: "TW"})
+	other := cache.VersionedKey("/api/v1/ad?country=JP&rank=priority", utils.PublicParams{Country: "JP"})
+	cache.RedisClient.Del(context.Background(), key, other)
+
+	now := time.Now()
+	createTestBanner(t, utils.AdminParams{
+		Title:      "Live",
+		StartAt:    now,
+		EndAt:      now.Add(time.Hour),
+		Conditions: utils.ConditionParams{Country: []string{"TW"}},
+	})
+	createTestBanner(t, utils.AdminParams{
+		Title:      "Upcoming",
+		StartAt:    now.Add(30 * time.Second),
+		EndAt:      now.Add(time.Hour),
+		Conditions: utils.ConditionParams{Country: []string{"TW"}},
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/ad?country=TW", nil)
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	// the response goes stale when the upcoming banner starts
+	ttl, err := cache.RedisClient.TTL(context.Background(), key).Result()
+	assert.NilError(t, err)
+	assert.Assert(t, ttl > 0 && ttl <= 31*time.Second+cache.StaleTTL)
+
+	// a query the upcoming banner cannot match keeps the default ttl
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/ad?country=JP", nil)
+	testRouter.ServeHTTP(w, req)
+	ttl, err = cache.RedisClient.TTL(context.Background(), other).Result()
+	assert.NilError(t, err)
+	assert.Assert(t, ttl > time.Minute)
+
+	// once the banner starts, the evictor drops the responses it can appear in
+	err = jobs.EvictCrossedBanners(context.Background(), testStore, now, now.Add(time.Minute))
+	assert.NilError(t, err)
+
+	exists, _ := cache.RedisClient.Exists(context.Background(), key, other).Result()
+	assert.Equal(t, int64(1), exists)
+	exists, _ = cache.RedisClient.Exists(context.Background(), other).Result()
+	assert.Equal(t, int64(1), exists)
+}
+
+func TestWarmCacheAPI(t *testing.T) {
+	load_test.DeleteAllData()
+	os.Setenv("AD_RANK", "")
+	os.Setenv("CACHE_WARM_QUERIES", "country=TW,gender=F&platform=ios,age=200")
+	// queries missed by the other tests are left out
+	os.Setenv("CACHE_WARM_TOP", "0")
+
+	createTestBanner(t, utils.AdminParams{
+		Title:   "warm banner",
+		StartAt: time.Now(),
+		EndAt:   time.Now().Add(time.Hour),
+	})
+
+	keys := []string{
+		cache.VersionedKey("/api/v1/ad?rank=priority", utils.PublicParams{}),
+		cache.VersionedKey("/api/v1/ad?country=TW&rank=priority", utils.PublicParams{Country: "TW"}),
+		cache.VersionedKey("/api/v1/ad?gender=F&platform=ios&rank=priority", utils.PublicParams{Gender: "F", Platform: "ios"}),
+	}
+	cache.RedisClient.Del(context.Background(), keys...)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/admin/cache/warm", nil)
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	// the unfiltered and the configured queries are cached, the invalid one is skipped
+	exists, err := cache.RedisClient.Exists(context.Background(), keys...).Result()
+	assert.NilError(t, err)
+	assert.Equal(t, int64(len(keys)), exists)
+
+	// warming again leaves the cached queries alone
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/admin/cache/warm", nil)
+	testRouter.ServeHTTP(w, req)
+
+	var got struct {
+		Warmed int `json:"warmed"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &got)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 0, got.Warmed)
+
+	os.Setenv("CACHE_WARM_QUERIES", "")
+	os.Setenv("CACHE_WARM_TOP", "")
+}
+
+func TestInvalidateCacheAPI(t *testing.T) {
+	load_test.DeleteAllData()
+	os.Setenv("AD_RANK", "")
+
+	createTestBanner(t, utils.AdminParams{
+		Title:   "invalidate banner",
+		StartAt: time.Now(),
+		EndAt:   time.Now().Add(time.Hour),
+	})
+
+	tw := utils.PublicParams{Country: "TW"}
+	jp := utils.PublicParams{Country: "JP"}
+	twKey := cache.VersionedKey("/api/v1/ad?country=TW&rank=priority", tw)
+	jpKey := cache.VersionedKey("/api/v1/ad?country=JP&rank=priority", jp)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/admin/cache/invalidate?dimension=country&value=TW", nil)
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	// only the queries on TW move to a new namespace
+	assert.Assert(t, cache.VersionedKey("/api/v1/ad?country=TW&rank=priority", tw) != twKey)
+	assert.Equal(t, jpKey, cache.VersionedKey("/api/v1/ad?country=JP&rank=priority", jp))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/admin/cache/invalidate", nil)
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Assert(t, cache.VersionedKey("/api/v1/ad?country=JP&rank=priority", jp) != jpKey)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/admin/cache/invalidate?dimension=city", nil)
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+
+	// the dimension can also come as a JSON body
+	twKey = cache.VersionedKey("/api/v1/ad?country=TW&rank=priority", tw)
+	jpKey = cache.VersionedKey("/api/v1/ad?country=JP&rank=priority", jp)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/admin/cache/invalidate", bytes.NewBufferString(`{"dimension": "country", "value": "TW"}`))
+	req.Header.Set("Content-Type", "application/json")
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Assert(t, cache.VersionedKey("/api/v1/ad?country=TW&rank=priority", tw) != twKey)
+	assert.Equal(t, jpKey, cache.VersionedKey("/api/v1/ad?country=JP&rank=priority", jp))
+
+	// a body that cannot be read is rejected instead of invalidating everything
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/admin/cache/invalidate", bytes.NewBufferString("dimension=country&value=TW"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	testRouter.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, jpKey, cache.VersionedKey("/api/v1/ad?country=JP&rank=priority", jp))
+}
+
 func TestCacheMiddleware(t *testing.T) {
 	rc, mock := redismock.NewClientMock()
 	cache.RedisClient = rc
 
 	prepareFilteringMockData()
 
-	key := "/api/v1/ad?age=20"
-	data := []utils.Item{{Title: "TestAge", EndAt: time.Now().Add(1 * time.Hour)}}
+	os.Setenv("AD_RANK", "")
+	url := "/api/v1/ad?age=20"
+	key := cache.VersionedKey("/api/v1/ad?age=20&rank=priority", utils.PublicParams{Age: 20})
+	data := []utils.Item{{Title: "TestAge", EndAt: time.Now().Add(1 * time.Hour)}, {Title: "TestAll", EndAt: time.Now().Add(5 * time.Hour)}}
 	jsonData, _ := json.Marshal(data)
 
 	// Test cache hit
+	cache.Local.Purge()
 	mock.ExpectGet(key).SetVal(string(jsonData))
+	mock.ExpectPTTL(key).SetVal(time.Minute)
 
 	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", key, nil)
+	req, _ := http.NewRequest("GET", url, nil)
 	testRouter.ServeHTTP(w, req)
 
 	assert.Equal(t, 200, w.Code)
@@ -341,11 +1365,45 @@ func TestCacheMiddleware(t *testing.T) {
 		t.Errorf("There were unfulfilled expectations: %s", err)
 	}
 
+	// Test local cache hit, redis is not asked again
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", url, nil)
+	testRouter.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, string(jsonData), w.Body.String())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+
+	// Test the same query in another order with the defaults spelled out and an unknown parameter
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/ad?rank=priority&foo=bar&limit=5&age=20", nil)
+	testRouter.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, string(jsonData), w.Body.String())
+
+	// Test another page served from the same cached list
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/ad?age=20&offset=1&limit=1", nil)
+	testRouter.ServeHTTP(w, req)
+
+	page, _ := json.Marshal(data[1:])
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, string(page), w.Body.String())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+
 	// Test cache miss
+	cache.Local.Purge()
 	mock.ExpectGet(key).SetErr(fmt.Errorf("cache miss"))
 
 	w = httptest.NewRecorder()
-	req, _ = http.NewRequest("GET", key, nil)
+	req, _ = http.NewRequest("GET", url, nil)
 	testRouter.ServeHTTP(w, req)
 
 	var got []utils.Item
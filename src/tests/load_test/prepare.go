@@ -3,12 +3,16 @@ package load_test
 import (
 	"fmt"
 	"main/models"
+	"math/rand"
+	"time"
 )
 
 const rows = 1000
 
 func DeleteAllData() {
-	err := models.DB.Exec(`delete from banners;
+	err := models.DB.Exec(`delete from banner_stats;
+	delete from experiments;
+	delete from banners;
 	delete from countries;
 	delete from genders;
 	delete from platforms;`).Error
@@ -18,39 +22,58 @@ func DeleteAllData() {
 	}
 }
 
+// random banners, each targeting about half of the genders, countries and platforms.
+// generated here instead of in sql so it runs on every database driver
 func InsertLoadTestData() {
-	sql := `
-	insert into genders (name) values ('M'), ('F');
-
-	insert into countries (name) values ('TW'), ('US'), ('JP'), ('KR'), ('CN'), ('HK'), ('CA'), ('UK'), ('FR'), ('DE'), ('IT');
-	insert into platforms (name) values ('ios'), ('android'), ('web');
-
-	insert into banners (title, start_at, end_at, age_start, age_end)
-	select 
-		'banner ' || i,
-		NOW() - INTERVAL '1 DAY' * (random() * 365)::INT,
-		NOW() + INTERVAL '1 DAY' * (random() * 365)::INT,
-		FLOOR((random()+i/1e39) * 50)::INT,
-		FLOOR((random()+i/1e39) * 50 + 50)::INT
-	from generate_series(1, %d) i;
-
-	insert into banner_country (banner_id, country_id)
-	select b.id, c.id 
-	from banners b 
-	join countries c on random() < 0.5;
-
-	insert into banner_gender
-	select b.id, g.id
-	from banners b
-	join genders g on random() < 0.5;
-
-	insert into banner_platform
-	select b.id, p.id
-	from banners b
-	join platforms p on random() < 0.5;`
+	genders := []models.Gender{{Name: "M"}, {Name: "F"}}
+	countries := []models.Country{{Name: "TW"}, {Name: "US"}, {Name: "JP"}, {Name: "KR"}, {Name: "CN"}, {Name: "HK"}, {Name: "CA"}, {Name: "UK"}, {Name: "FR"}, {Name: "DE"}, {Name: "IT"}}
+	platforms := []models.Platform{{Name: "ios"}, {Name: "android"}, {Name: "web"}}
+	for _, conditions := range []interface{}{&genders, &countries, &platforms} {
+		if err := models.DB.Create(conditions).Error; err != nil {
+			panic(err)
+		}
+	}
 
-	sql = fmt.Sprintf(sql, rows)
-	if err := models.DB.Exec(sql).Error; err != nil {
+	now := time.Now()
+	banners := make([]models.Banner, rows)
+	for i := range banners {
+		banners[i] = models.Banner{
+			Title:    fmt.Sprintf("banner %d", i+1),
+			StartAt:  now.AddDate(0, 0, -rand.Intn(366)),
+			EndAt:    now.AddDate(0, 0, rand.Intn(366)),
+			AgeStart: rand.Intn(50),
+			AgeEnd:   rand.Intn(50) + 50,
+		}
+	}
+	if err := models.DB.CreateInBatches(&banners, 100).Error; err != nil {
 		panic(err)
 	}
+
+	var bannerGender, bannerCountry, bannerPlatform []map[string]interface{}
+	for _, b := range banners {
+		for _, g := range genders {
+			if rand.Intn(2) == 0 {
+				bannerGender = append(bannerGender, map[string]interface{}{"banner_id": b.ID, "gender_id": g.ID})
+			}
+		}
+		for _, c := range countries {
+			if rand.Intn(2) == 0 {
+				bannerCountry = append(bannerCountry, map[string]interface{}{"banner_id": b.ID, "country_id": c.ID})
+			}
+		}
+		for _, p := range platforms {
+			if rand.Intn(2) == 0 {
+				bannerPlatform = append(bannerPlatform, map[string]interface{}{"banner_id": b.ID, "platform_id": p.ID})
+			}
+		}
+	}
+	joins := map[string][]map[string]interface{}{"banner_gender": bannerGender, "banner_country": bannerCountry, "banner_platform": bannerPlatform}
+	for table, links := range joins {
+		if len(links) == 0 {
+			continue
+		}
+		if err := models.DB.Table(table).CreateInBatches(links, 500).Error; err != nil {
+			panic(err)
+		}
+	}
 }
@@ -0,0 +1,79 @@
+package unit_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"main/cache"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := cache.NewCircuitBreaker(2, 50*time.Millisecond)
+
+	// stands in for redis, answering with reply and counting the commands that reach it
+	var reply error
+	calls := 0
+	process := breaker.ProcessHook(func(ctx context.Context, cmd redis.Cmder) error {
+		calls++
+		cmd.SetErr(reply)
+		return reply
+	})
+	get := func() error {
+		return process(context.Background(), redis.NewStringCmd(context.Background(), "get", "key"))
+	}
+
+	// a missing key is a reply, not a failure
+	reply = redis.Nil
+	get()
+	get()
+	if open, _ := breaker.Open(); open {
+		t.Errorf("Breaker should stay closed on missing keys")
+	}
+
+	// the breaker opens after two failures in a row
+	reply = fmt.Errorf("connection refused")
+	get()
+	get()
+	if open, _ := breaker.Open(); !open {
+		t.Errorf("Breaker should be open after two failures")
+	}
+
+	// commands are rejected without reaching redis
+	calls = 0
+	if err := get(); !errors.Is(err, cache.ErrCircuitOpen) {
+		t.Errorf("Expected ErrCircuitOpen, got %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("Command should not reach redis while the breaker is open")
+	}
+
+	// after the cooldown a successful probe closes it again
+	time.Sleep(60 * time.Millisecond)
+	reply = nil
+	if err := get(); err != nil {
+		t.Errorf("Error was not expected while probing redis: %v", err)
+	}
+	if open, _ := breaker.Open(); open {
+		t.Errorf("Breaker should be closed after a successful probe")
+	}
+
+	// a failed probe opens it right away
+	reply = fmt.Errorf("connection refused")
+	get()
+	get()
+	time.Sleep(60 * time.Millisecond)
+
+	get()
+	if open, _ := breaker.Open(); !open {
+		t.Errorf("Breaker should open again after a failed probe")
+	}
+	calls = 0
+	get()
+	if calls != 0 {
+		t.Errorf("Command should not reach redis after a failed probe")
+	}
+}
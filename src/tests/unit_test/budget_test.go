@@ -0,0 +1,98 @@
+package unit_test
+
+import (
+	"context"
+	"main/cache"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"gotest.tools/assert"
+)
+
+func TestBudgetAllowed(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+	end := start.Add(10 * 24 * time.Hour)
+
+	tests := []struct {
+		name         string
+		budget       cache.Budget
+		now          time.Time
+		wantDaily    int64
+		wantLifetime int64
+	}{
+		{
+			name:         "Unlimited",
+			budget:       cache.Budget{StartAt: start, EndAt: end},
+			now:          start.Add(time.Hour),
+			wantDaily:    -1,
+			wantLifetime: -1,
+		},
+		{
+			name:         "Start of window",
+			budget:       cache.Budget{Lifetime: 1000, StartAt: start, EndAt: end},
+			now:          start,
+			wantDaily:    -1,
+			wantLifetime: 1,
+		},
+		{
+			name:         "Half of window",
+			budget:       cache.Budget{Lifetime: 1000, StartAt: start, EndAt: end},
+			now:          start.Add(5 * 24 * time.Hour),
+			wantDaily:    -1,
+			wantLifetime: 501,
+		},
+		{
+			name:         "Quarter of day",
+			budget:       cache.Budget{Daily: 100, StartAt: start, EndAt: end},
+			now:          start.Add(2*24*time.Hour + 6*time.Hour),
+			wantDaily:    26,
+			wantLifetime: -1,
+		},
+		{
+			name:         "Window ended",
+			budget:       cache.Budget{Daily: 100, Lifetime: 1000, StartAt: start, EndAt: end},
+			now:          end.Add(time.Hour),
+			wantDaily:    100,
+			wantLifetime: 1000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			daily, lifetime := tt.budget.Allowed(tt.now)
+			assert.Equal(t, tt.wantDaily, daily)
+			assert.Equal(t, tt.wantLifetime, lifetime)
+		})
+	}
+}
+
+func TestThrottledBanners(t *testing.T) {
+	rc, mock := redismock.NewClientMock()
+	cache.RedisClient = rc
+
+	now := time.Now()
+	budgets := []cache.Budget{
+		// far behind its pace
+		{BannerID: 1, Lifetime: 1000000, StartAt: now.Add(-time.Hour), EndAt: now.Add(time.Hour)},
+		// already spent its whole day
+		{BannerID: 2, Daily: 10, StartAt: now.Add(-time.Hour), EndAt: now.Add(time.Hour)},
+	}
+	day := now.Format("20060102")
+	keys := []string{"budget:{1}:d:" + day, "budget:{1}:l", "budget:{2}:d:" + day, "budget:{2}:l"}
+
+	// the mock stops a pipeline at a missing key, so only the last one is missing
+	mock.ExpectGet(keys[0]).SetVal("0")
+	mock.ExpectGet(keys[1]).SetVal("3")
+	mock.ExpectGet(keys[2]).SetVal("10")
+	mock.ExpectGet(keys[3]).RedisNil()
+
+	throttled, err := cache.ThrottledBanners(context.Background(), budgets)
+
+	assert.NilError(t, err)
+	assert.DeepEqual(t, map[uint]bool{2: true}, throttled)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
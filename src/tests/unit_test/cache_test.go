@@ -7,12 +7,31 @@ import (
 	"main/cache"
 	"main/utils"
 	"math/rand"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
 )
 
+// matches a command by its name and key, for arguments that depend on the current time
+func matchNameAndKey(expected, actual []interface{}) error {
+	if len(expected) < 2 || len(actual) < 2 || expected[0] != actual[0] || expected[1] != actual[1] {
+		return fmt.Errorf("expected %v, got %v", expected, actual)
+	}
+	return nil
+}
+
+// matches a PEXPIREAT by its key and option, the time depends on the current time
+func matchExpireAt(expected, actual []interface{}) error {
+	if len(expected) != 4 || len(actual) != 4 || expected[1] != actual[1] || expected[3] != actual[3] {
+		return fmt.Errorf("expected %v, got %v", expected, actual)
+	}
+	return nil
+}
+
 func TestSetCache(t *testing.T) {
 	rc, mock := redismock.NewClientMock()
 	cache.RedisClient = rc
@@ -25,10 +44,18 @@ func TestSetCache(t *testing.T) {
 	}
 	jsonValue, _ := json.Marshal(newValue)
 
+	expectSet := func(ttl time.Duration) {
+		mock.ExpectSet(newKey, string(jsonValue), ttl).SetVal("OK")
+		mock.CustomMatch(matchNameAndKey).ExpectZAdd("cache:keys", redis.Z{Member: newKey}).SetVal(1)
+		mock.CustomMatch(matchExpireAt).ExpectDo("pexpireat", "cache:keys", int64(0), "NX").SetVal(int64(1))
+		mock.CustomMatch(matchExpireAt).ExpectDo("pexpireat", "cache:keys", int64(0), "GT").SetVal(int64(0))
+	}
+
 	// Normal case
-	mock.ExpectSet(newKey, string(jsonValue), 5*time.Minute).SetVal("OK")
+	expectSet(5 * time.Minute)
+	mock.ExpectGet("cache:generation").SetVal("3")
 
-	err := cache.SetCache(context.Background(), newKey, newValue)
+	err := cache.SetCache(context.Background(), newKey, newValue, cache.DefaultTTL, 3)
 
 	if err != nil {
 		fmt.Println(err)
@@ -39,75 +66,142 @@ func TestSetCache(t *testing.T) {
 		t.Errorf("There were unfulfilled expectations: %s", err)
 	}
 
+	// Invalidated during the search, the response is dropped again
+	expectSet(5 * time.Minute)
+	mock.ExpectGet("cache:generation").SetVal("4")
+	mock.ExpectDel(newKey).SetVal(1)
+	mock.ExpectPublish("cache:invalidate", newKey).SetVal(1)
+
+	err = cache.SetCache(context.Background(), newKey, newValue, cache.DefaultTTL, 3)
+
+	if err != nil {
+		t.Errorf("Error was not expected while setting cache")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+
 	// Error case
 	mock.ExpectSet(newKey, string(jsonValue), 5*time.Minute).SetErr(fmt.Errorf("error setting cache"))
 
-	err = cache.SetCache(context.Background(), newKey, newValue)
+	err = cache.SetCache(context.Background(), newKey, newValue, cache.DefaultTTL, 3)
 
-	if err.Error() != "error setting cache" {
+	if err == nil || err.Error() != "error setting cache" {
 		t.Errorf("Error was expected while setting cache")
 	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("There were unfulfilled expectations: %s", err)
 	}
-}
 
-func TestAddConditionCache(t *testing.T) {
-	rc, mock := redismock.NewClientMock()
-	cache.RedisClient = rc
-
-	conditionKind := "age"
-	newKey := "http://localhost:8080/api/v1/ad?age=20&gender=M&country=US"
-
-	// Normal case
-	mock.ExpectLPush(conditionKind, newKey).SetVal(1)
+	// Shorter ttl, no invalidation yet
+	expectSet(30 * time.Second)
+	mock.ExpectGet("cache:generation").RedisNil()
 
-	err := cache.AddConditionCache(context.Background(), conditionKind, newKey)
+	err = cache.SetCache(context.Background(), newKey, newValue, 30*time.Second, 0)
 
 	if err != nil {
-		t.Errorf("Error was not expected while adding condition cache")
+		t.Errorf("Error was not expected while setting cache")
 	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("There were unfulfilled expectations: %s", err)
 	}
+}
 
-	// Error case
-	mock.ExpectLPush(conditionKind, newKey).SetErr(fmt.Errorf("error adding condition cache"))
+// a short lived response must not expire the index entries of the longer ones
+func TestSetCacheKeepsIndex(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache.RedisClient = redis.NewClient(&redis.Options{Addr: server.Addr()})
+	ctx := context.Background()
 
-	err = cache.AddConditionCache(context.Background(), conditionKind, newKey)
+	long, short := "/api/v1/ad?country=TW&rank=priority#v0", "/api/v1/ad?country=US&rank=priority#v0"
+	items := []utils.Item{{Title: "Test"}}
+	if err := cache.SetCache(ctx, long, items, cache.DefaultTTL, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.SetCache(ctx, short, items, time.Second, 0); err != nil {
+		t.Fatal(err)
+	}
 
-	if err.Error() != "error adding condition cache" {
-		t.Errorf("Error was expected while adding condition cache")
+	server.FastForward(time.Second + cache.StaleTTL + time.Second)
+	if !server.Exists("cache:keys") {
+		t.Fatal("the index expired before the responses it holds")
 	}
 
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("There were unfulfilled expectations: %s", err)
+	if err := cache.DeleteMatchingCache(ctx, func(utils.PublicParams) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists(long) {
+		t.Errorf("%s should have been invalidated", long)
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	rc, mock := redismock.NewClientMock()
+	cache.RedisClient = rc
+
+	mock.ExpectGet("cache:generation").RedisNil()
+	generation, err := cache.Generation(context.Background())
+	if err != nil || generation != 0 {
+		t.Errorf("Generation should start at 0, got %d, %v", generation, err)
+	}
+
+	mock.ExpectGet("cache:generation").SetVal("7")
+	generation, err = cache.Generation(context.Background())
+	if err != nil || generation != 7 {
+		t.Errorf("Generation should be 7, got %d, %v", generation, err)
 	}
 }
 
-func TestDeleteConditionCache(t *testing.T) {
+func TestDeleteMatchingCache(t *testing.T) {
 	rc, mock := redismock.NewClientMock()
 	cache.RedisClient = rc
 
 	mockKeys := []string{
-		"http://localhost:8080/api/v1/ad?age=20",
-		"http://localhost:8080/api/v1/ad?age=30",
-		"http://localhost:8080/api/v1/ad?age=23",
+		"/api/v1/ad?",
+		"/api/v1/ad?country=TW",
+		"/api/v1/ad?country=JP",
+		"/api/v1/ad?age=20&country=TW",
+		"/api/v1/ad?age=40&country=TW",
+	}
+
+	// a banner for TW users aged 18 to 30
+	banner := utils.ConditionParams{AgeStart: 18, AgeEnd: 30, Country: []string{"TW"}}
+	affected := []string{mockKeys[0], mockKeys[1], mockKeys[3]}
+
+	expectIndex := func(keys []string) {
+		mock.ExpectIncr("cache:generation").SetVal(1)
+		mock.CustomMatch(matchNameAndKey).ExpectZRemRangeByScore("cache:keys", "-inf", "").SetVal(0)
+		mock.ExpectZRange("cache:keys", 0, -1).SetVal(keys)
 	}
 
 	// Normal case
-	mock.ExpectLRange("age", 0, -1).SetVal(mockKeys)
-	for _, k := range mockKeys {
+	expectIndex(mockKeys)
+	for _, k := range affected {
 		mock.ExpectDel(k).SetVal(1)
 	}
-	mock.ExpectDel("age").SetVal(1)
+	mock.ExpectZRem("cache:keys", affected[0], affected[1], affected[2]).SetVal(3)
+	mock.ExpectPublish("cache:invalidate", strings.Join(affected, "\n")).SetVal(1)
 
-	err := cache.DeleteConditionCache(context.Background(), "age")
+	err := cache.DeleteMatchingCache(context.Background(), banner.Matches)
 
 	if err != nil {
-		t.Errorf("Error was not expected while deleting condition cache")
+		t.Errorf("Error was not expected while deleting matching cache")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+
+	// Nothing affected
+	expectIndex(mockKeys[2:3])
+
+	err = cache.DeleteMatchingCache(context.Background(), banner.Matches)
+
+	if err != nil {
+		t.Errorf("Error was not expected while deleting matching cache")
 	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -115,11 +209,11 @@ func TestDeleteConditionCache(t *testing.T) {
 	}
 
 	// Error case 1
-	mock.ExpectLRange("age", 0, -1).SetErr(fmt.Errorf("error fetching kind from redis"))
-	err = cache.DeleteConditionCache(context.Background(), "age")
+	mock.ExpectIncr("cache:generation").SetErr(fmt.Errorf("error bumping generation"))
+	err = cache.DeleteMatchingCache(context.Background(), banner.Matches)
 
-	if err.Error() != "error fetching kind from redis" {
-		t.Errorf("Error was expected while deleting condition cache")
+	if err == nil || err.Error() != "error bumping generation" {
+		t.Errorf("Error was expected while deleting matching cache")
 	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -127,16 +221,106 @@ func TestDeleteConditionCache(t *testing.T) {
 	}
 
 	// Error case 2
-	mock.ExpectLRange("age", 0, -1).SetVal(mockKeys)
-	mock.ExpectDel(mockKeys[0]).SetErr(fmt.Errorf("error fetching data from redis"))
+	expectIndex(mockKeys)
+	mock.ExpectDel(affected[0]).SetErr(fmt.Errorf("error deleting data from redis"))
 
-	err = cache.DeleteConditionCache(context.Background(), "age")
+	err = cache.DeleteMatchingCache(context.Background(), banner.Matches)
 
-	if err.Error() != "error fetching data from redis" {
-		t.Errorf("Error was expected while deleting condition cache")
+	if err == nil || err.Error() != "error deleting data from redis" {
+		t.Errorf("Error was expected while deleting matching cache")
 	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("There were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestConditionMatches(t *testing.T) {
+	banner := utils.ConditionParams{
+		AgeStart:        20,
+		AgeEnd:          30,
+		Gender:          []string{"F"},
+		ExcludeCountry:  []string{"JP"},
+		ExcludePlatform: []string{"web"},
+	}
+
+	cases := []struct {
+		query utils.PublicParams
+		want  bool
+	}{
+		{utils.PublicParams{}, true},
+		{utils.PublicParams{Age: 25}, true},
+		{utils.PublicParams{Age: 31}, false},
+		{utils.PublicParams{Gender: "F"}, true},
+		{utils.PublicParams{Gender: "M"}, false},
+		{utils.PublicParams{Country: "TW"}, true},
+		{utils.PublicParams{Country: "JP"}, false},
+		{utils.PublicParams{Platform: "ios"}, true},
+		{utils.PublicParams{Platform: "web"}, false},
+	}
+
+	for _, tc := range cases {
+		if got := banner.Matches(tc.query); got != tc.want {
+			t.Errorf("Matches(%+v) = %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	// no conditions matches every query
+	if !(utils.ConditionParams{}).Matches(utils.PublicParams{Age: 60, Gender: "M", Country: "JP", Platform: "web"}) {
+		t.Errorf("A banner without conditions should match every query")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	want := "/api/v1/ad?age=20&gender=M&rank=priority"
+
+	// pagination does not change the key
+	cases := []utils.PublicParams{
+		{Age: 20, Gender: "M", Limit: 5, Rank: "priority"},
+		{Gender: "M", Age: 20, Rank: "priority", Limit: 5, Offset: 10},
+	}
+	for _, p := range cases {
+		if got := p.CacheKey("/api/v1/ad"); got != want {
+			t.Errorf("CacheKey() = %s, want %s", got, want)
+		}
+	}
+
+	p := utils.PublicParams{Country: "TW", Platform: "ios", Timezone: "Asia/Taipei", Limit: 5, Rank: "end_at"}
+	want = "/api/v1/ad?country=TW&platform=ios&rank=end_at&tz=Asia%2FTaipei"
+	if got := p.CacheKey("/api/v1/ad"); got != want {
+		t.Errorf("CacheKey() = %s, want %s", got, want)
+	}
+
+	// the key parses back to the same conditions
+	if parsed := cache.ParseKey(want); parsed.Country != "TW" || parsed.Platform != "ios" {
+		t.Errorf("ParseKey(%s) = %+v", want, parsed)
+	}
+}
+
+func TestPage(t *testing.T) {
+	items := []utils.Item{{ID: 1}, {ID: 2}, {ID: 3}}
+
+	cases := []struct {
+		offset, limit int
+		want          []uint
+	}{
+		{0, 5, []uint{1, 2, 3}},
+		{1, 1, []uint{2}},
+		{2, 5, []uint{3}},
+		{3, 5, nil},
+		{-1, 2, []uint{1, 2}},
+	}
+
+	for _, tc := range cases {
+		page := utils.PublicParams{Offset: tc.offset, Limit: tc.limit}.Page(items)
+		if len(page) != len(tc.want) {
+			t.Errorf("Page(%d, %d) returned %d items, want %d", tc.offset, tc.limit, len(page), len(tc.want))
+			continue
+		}
+		for i, item := range page {
+			if item.ID != tc.want[i] {
+				t.Errorf("Page(%d, %d)[%d] = %d, want %d", tc.offset, tc.limit, i, item.ID, tc.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package unit_test
+
+import (
+	"main/cache"
+	"os"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+	"gotest.tools/assert"
+)
+
+func TestNewClientFromEnv(t *testing.T) {
+	setEnv := func(vars map[string]string) {
+		for k, v := range vars {
+			os.Setenv("UNIT_REDIS_"+k, v)
+			t.Cleanup(func() { os.Unsetenv("UNIT_REDIS_" + k) })
+		}
+	}
+
+	// standalone from host and port
+	setEnv(map[string]string{"HOST": "localhost", "PORT": "6379", "DB": "2", "POOL_SIZE": "20", "READ_TIMEOUT": "500ms"})
+	client, err := cache.NewClientFromEnv("UNIT_REDIS_")
+	assert.NilError(t, err)
+	standalone, ok := client.(*redis.Client)
+	assert.Assert(t, ok)
+	assert.Equal(t, "localhost:6379", standalone.Options().Addr)
+	assert.Equal(t, 2, standalone.Options().DB)
+	assert.Equal(t, 20, standalone.Options().PoolSize)
+	client.Close()
+
+	// db 0 is the only one in a cluster
+	setEnv(map[string]string{"MODE": "cluster", "ADDRS": "node1:6379, node2:6379", "TLS": "true"})
+	_, err = cache.NewClientFromEnv("UNIT_REDIS_")
+	assert.Error(t, err, "redis cluster only has db 0")
+
+	setEnv(map[string]string{"DB": ""})
+	client, err = cache.NewClientFromEnv("UNIT_REDIS_")
+	assert.NilError(t, err)
+	cluster, ok := client.(*redis.ClusterClient)
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, []string{"node1:6379", "node2:6379"}, cluster.Options().Addrs)
+	assert.Assert(t, cluster.Options().TLSConfig != nil)
+	client.Close()
+
+	// sentinel needs the master name
+	setEnv(map[string]string{"MODE": "sentinel"})
+	_, err = cache.NewClientFromEnv("UNIT_REDIS_")
+	assert.Error(t, err, "UNIT_REDIS_MASTER_NAME is required in sentinel mode")
+
+	setEnv(map[string]string{"MASTER_NAME": "mymaster"})
+	client, err = cache.NewClientFromEnv("UNIT_REDIS_")
+	assert.NilError(t, err)
+	client.Close()
+
+	// invalid values
+	setEnv(map[string]string{"MODE": "ring"})
+	_, err = cache.NewClientFromEnv("UNIT_REDIS_")
+	assert.Error(t, err, "invalid UNIT_REDIS_MODE: ring")
+
+	setEnv(map[string]string{"MODE": "", "DIAL_TIMEOUT": "soon"})
+	_, err = cache.NewClientFromEnv("UNIT_REDIS_")
+	assert.Error(t, err, "invalid UNIT_REDIS_DIAL_TIMEOUT: soon")
+}
@@ -0,0 +1,57 @@
+package unit_test
+
+import (
+	"context"
+	"fmt"
+	"main/cache"
+	"main/models"
+	"testing"
+
+	"github.com/go-redis/redismock/v9"
+	"gotest.tools/assert"
+)
+
+func TestExperimentAssign(t *testing.T) {
+	experiment := models.Experiment{
+		ID: 42,
+		Variants: []models.Variant{
+			{ID: 1, Weight: 1},
+			{ID: 2, Weight: 3},
+		},
+	}
+
+	counts := map[uint]int{}
+	for i := 0; i < 4000; i++ {
+		userID := fmt.Sprintf("user-%d", i)
+		variant := experiment.Assign(userID)
+
+		// Assignment is stable
+		assert.Equal(t, variant.ID, experiment.Assign(userID).ID)
+		counts[variant.ID]++
+	}
+
+	// Traffic follows the weights
+	assert.Assert(t, counts[1] > 800 && counts[1] < 1200, counts[1])
+	assert.Assert(t, counts[2] > 2800 && counts[2] < 3200, counts[2])
+
+	// No variants, no assignment
+	assert.Assert(t, (&models.Experiment{ID: 1}).Assign("user") == nil)
+}
+
+func TestVariantCounts(t *testing.T) {
+	rc, mock := redismock.NewClientMock()
+	cache.RedisClient = rc
+
+	mock.ExpectHMGet("variants:exposures", "1", "2").SetVal([]interface{}{"10", nil})
+	mock.ExpectHMGet("variants:clicks", "1", "2").SetVal([]interface{}{"3", nil})
+
+	exposures, clicks, err := cache.VariantCounts(context.Background(), []uint{1, 2})
+
+	assert.NilError(t, err)
+	assert.DeepEqual(t, map[uint]int64{1: 10, 2: 0}, exposures)
+	assert.DeepEqual(t, map[uint]int64{1: 3, 2: 0}, clicks)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,119 @@
+package unit_test
+
+import (
+	"context"
+	"fmt"
+	"main/cache"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
+	"gotest.tools/assert"
+)
+
+func TestCappedBanners(t *testing.T) {
+	rc, mock := redismock.NewClientMock()
+	cache.RedisClient = rc
+
+	now := time.Now()
+	caps := []cache.FrequencyCap{
+		{BannerID: 1, Hourly: 2},
+		{BannerID: 2, Daily: 3, Lifetime: 10},
+		{BannerID: 3},
+	}
+	keys := []string{
+		"freq:{u1}:1:h:" + now.Format("2006010215"),
+		"freq:{u1}:2:d:" + now.Format("20060102"),
+		"freq:{u1}:2:l",
+	}
+
+	// Normal case
+	mock.ExpectMGet(keys...).SetVal([]interface{}{"2", "1", nil})
+
+	capped, err := cache.CappedBanners(context.Background(), "u1", caps)
+
+	assert.NilError(t, err)
+	assert.DeepEqual(t, map[uint]bool{1: true}, capped)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+
+	// No capped banners means no redis round trip
+	capped, err = cache.CappedBanners(context.Background(), "u1", caps[2:])
+
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(capped))
+
+	// Error case
+	mock.ExpectMGet(keys...).SetErr(fmt.Errorf("error fetching counters"))
+
+	_, err = cache.CappedBanners(context.Background(), "u1", caps)
+
+	if err == nil || err.Error() != "error fetching counters" {
+		t.Errorf("Error was expected while fetching counters")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRecordImpressions(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache.RedisClient = redis.NewClient(&redis.Options{Addr: server.Addr()})
+
+	now := time.Now()
+	endAt := now.Add(48 * time.Hour)
+	caps := []cache.FrequencyCap{
+		{BannerID: 1, Hourly: 2, EndAt: endAt},
+		{BannerID: 2},
+	}
+	hourly := "freq:{u1}:1:h:" + now.Format("2006010215")
+
+	for i := 0; i < 2; i++ {
+		capped, err := cache.RecordImpressions(context.Background(), "u1", caps)
+		assert.NilError(t, err)
+		assert.Equal(t, 0, len(capped))
+	}
+
+	// the third one is over the cap and not counted
+	capped, err := cache.RecordImpressions(context.Background(), "u1", caps)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, map[uint]bool{1: true}, capped)
+
+	count, _ := server.Get(hourly)
+	assert.Equal(t, "2", count)
+	assert.Equal(t, time.Hour, server.TTL(hourly))
+	assert.Assert(t, !server.Exists("freq:{u1}:2:l"))
+}
+
+// parallel requests of the same user cannot all pass the check before any of them counts
+func TestRecordImpressionsConcurrently(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache.RedisClient = redis.NewClient(&redis.Options{Addr: server.Addr()})
+
+	caps := []cache.FrequencyCap{{BannerID: 1, Lifetime: 3, EndAt: time.Now().Add(time.Hour)}}
+
+	var wg sync.WaitGroup
+	var served atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			capped, err := cache.RecordImpressions(context.Background(), "u1", caps)
+			if err == nil && !capped[1] {
+				served.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(3), served.Load())
+	count, _ := server.Get("freq:{u1}:1:l")
+	assert.Equal(t, "3", count)
+}
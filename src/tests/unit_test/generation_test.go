@@ -0,0 +1,64 @@
+package unit_test
+
+import (
+	"context"
+	"main/cache"
+	"main/utils"
+	"testing"
+
+	"github.com/go-redis/redismock/v9"
+	"gotest.tools/assert"
+)
+
+func TestVersionedKey(t *testing.T) {
+	rc, mock := redismock.NewClientMock()
+	cache.RedisClient = rc
+
+	mock.ExpectHGetAll("cache:generations").SetVal(map[string]string{"global": "2", "country": "1", "country:TW": "3", "gender:F": "4"})
+	assert.NilError(t, cache.LoadGenerations(context.Background()))
+
+	tw := utils.PublicParams{Country: "TW", Rank: "priority"}
+	jp := utils.PublicParams{Country: "JP", Rank: "priority"}
+	all := utils.PublicParams{Rank: "priority"}
+	key := func(p utils.PublicParams) string {
+		return cache.VersionedKey(p.CacheKey("/api/v1/ad"), p)
+	}
+
+	assert.Equal(t, "/api/v1/ad?country=TW&rank=priority#v2.1-3", key(tw))
+	assert.Equal(t, "/api/v1/ad?country=JP&rank=priority#v2.1-0", key(jp))
+	assert.Equal(t, "/api/v1/ad?rank=priority#v2", key(all))
+
+	// bumping TW only moves the TW queries
+	twKey, jpKey, allKey := key(tw), key(jp), key(all)
+	mock.ExpectHIncrBy("cache:generations", "country:TW", 1).SetVal(4)
+	mock.ExpectPublish("cache:generations", "country:TW=4").SetVal(1)
+
+	n, err := cache.BumpGeneration(context.Background(), "country", "TW")
+	assert.NilError(t, err)
+	assert.Equal(t, int64(4), n)
+	assert.Assert(t, key(tw) != twKey)
+	assert.Equal(t, jpKey, key(jp))
+	assert.Equal(t, allKey, key(all))
+
+	// bumping the global generation moves every query
+	mock.ExpectHIncrBy("cache:generations", "global", 1).SetVal(3)
+	mock.ExpectPublish("cache:generations", "global=3").SetVal(1)
+
+	_, err = cache.BumpGeneration(context.Background(), "", "")
+	assert.NilError(t, err)
+	assert.Assert(t, key(jp) != jpKey)
+	assert.Assert(t, key(all) != allKey)
+
+	_, err = cache.BumpGeneration(context.Background(), "city", "")
+	assert.Error(t, err, "invalid dimension: city")
+
+	// a reload that read the hash before the bump does not move the counter back
+	bumped := key(tw)
+	mock.ExpectHGetAll("cache:generations").SetVal(map[string]string{"global": "2", "country": "1", "country:TW": "3"})
+	assert.NilError(t, cache.LoadGenerations(context.Background()))
+	assert.Equal(t, bumped, key(tw))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
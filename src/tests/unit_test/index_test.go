@@ -0,0 +1,131 @@
+package unit_test
+
+import (
+	"fmt"
+	"main/models"
+	"main/utils"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestIndexedStoreMatchesMemoryStore(t *testing.T) {
+	store := models.NewMemoryStore()
+	now := time.Now()
+
+	banners := []utils.AdminParams{
+		{Title: "young", StartAt: now, EndAt: now.Add(time.Hour), Conditions: utils.ConditionParams{AgeStart: 18, AgeEnd: 30, Gender: []string{"F"}, Country: []string{"TW", "JP"}}},
+		{Title: "old", StartAt: now, EndAt: now.Add(2 * time.Hour), Conditions: utils.ConditionParams{AgeStart: 31, AgeEnd: 100, Platform: []string{"web"}}},
+		{Title: "us", Priority: 5, StartAt: now, EndAt: now.Add(3 * time.Hour), Conditions: utils.ConditionParams{Country: []string{"US"}, Gender: []string{"M"}}},
+		{Title: "mobile", StartAt: now, EndAt: now.Add(4 * time.Hour), Conditions: utils.ConditionParams{Platform: []string{"ios", "android"}, ExcludeCountry: []string{"JP"}}},
+		{Title: "all", StartAt: now, EndAt: now.Add(5 * time.Hour)},
+		{Title: "not web", StartAt: now, EndAt: now.Add(6 * time.Hour), Conditions: utils.ConditionParams{ExcludePlatform: []string{"web"}, ExcludeGender: []string{"F"}}},
+		{Title: "upcoming", StartAt: now.Add(time.Hour), EndAt: now.Add(7 * time.Hour)},
+		{Title: "paused", Status: models.StatusDraft, StartAt: now, EndAt: now.Add(time.Hour)},
+	}
+	for _, b := range banners {
+		store.CreateBanner("test", b)
+	}
+
+	index := models.NewIndexedStore(store)
+	assert.NilError(t, index.Load())
+
+	for _, age := range []int{0, 20, 35, 100} {
+		for _, country := range []string{"", "TW", "JP", "US"} {
+			for _, gender := range []string{"", "M", "F"} {
+				for _, platform := range []string{"", "ios", "web"} {
+					for _, rank := range []string{models.RankPriority, models.RankEndAt} {
+						p := utils.PublicParams{Age: age, Country: country, Gender: gender, Platform: platform, Rank: rank}
+
+						want, err := store.SearchBanner(p)
+						assert.NilError(t, err)
+						got, err := index.SearchBanner(p)
+						assert.NilError(t, err)
+						assert.DeepEqual(t, titles(want), titles(got))
+
+						wantNext, _, _ := store.NextBannerBoundary(p, now)
+						gotNext, _, _ := index.NextBannerBoundary(p, now)
+						assert.Equal(t, wantNext, gotNext, fmt.Sprintf("%+v", p))
+					}
+				}
+			}
+		}
+	}
+}
+
+// the cache ttl is bounded by how late the index can see another instance's write
+func TestIndexedStoreMaxStaleness(t *testing.T) {
+	t.Setenv("BANNER_INDEX_RELOAD", "10")
+	store := models.NewMemoryStore()
+	assert.Equal(t, time.Duration(0), store.MaxStaleness())
+	assert.Equal(t, 10*time.Second, models.NewIndexedStore(store).MaxStaleness())
+}
+
+func TestIndexedStoreWrites(t *testing.T) {
+	index := models.NewIndexedStore(models.NewMemoryStore())
+	assert.NilError(t, index.Load())
+	now := time.Now()
+
+	id, err := index.CreateBanner("test", utils.AdminParams{Title: "tw", StartAt: now, EndAt: now.Add(time.Hour), Conditions: utils.ConditionParams{Country: []string{"TW"}}})
+	assert.NilError(t, err)
+
+	search := func(p utils.PublicParams) []string {
+		items, err := index.SearchBanner(p)
+		assert.NilError(t, err)
+		return titles(items)
+	}
+
+	assert.DeepEqual(t, []string{"tw"}, search(utils.PublicParams{Country: "TW"}))
+	assert.DeepEqual(t, []string{}, search(utils.PublicParams{Country: "US"}))
+
+	// an update moves the banner to its new conditions
+	err = index.UpdateBanner("test", id, utils.AdminParams{Title: "us", StartAt: now, EndAt: now.Add(time.Hour), Conditions: utils.ConditionParams{Country: []string{"US"}}})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{}, search(utils.PublicParams{Country: "TW"}))
+	assert.DeepEqual(t, []string{"us"}, search(utils.PublicParams{Country: "US"}))
+
+	// creatives are served with the banner
+	_, err = index.CreateCreative(id, utils.CreativeParams{ImageURL: "https://example.com/a.png", LinkURL: "https://example.com"})
+	assert.NilError(t, err)
+	items, _ := index.SearchBanner(utils.PublicParams{})
+	assert.Equal(t, 1, len(items[0].Creatives))
+
+	// promoting a variant renames the banner
+	experimentID, err := index.CreateExperiment(utils.ExperimentParams{BannerID: id, Variants: []utils.VariantParams{{Name: "a", Weight: 1}, {Name: "b", Title: "winner", Weight: 1}}})
+	assert.NilError(t, err)
+	experiment, err := index.GetExperiment(experimentID)
+	assert.NilError(t, err)
+	_, err = index.PromoteVariant("test", experimentID, experiment.Variants[1].ID, nil, nil)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"winner"}, search(utils.PublicParams{Country: "US"}))
+
+	// a banner that is not serving leaves the index
+	_, err = index.TransitionBanner("test", id, models.StatusPaused)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{}, search(utils.PublicParams{}))
+
+	_, err = index.TransitionBanner("test", id, models.StatusActive)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"winner"}, search(utils.PublicParams{}))
+
+	assert.NilError(t, index.DeleteBanner("test", id))
+	assert.DeepEqual(t, []string{}, search(utils.PublicParams{}))
+	assert.Equal(t, models.ErrBannerNotFound, index.DeleteBanner("test", id))
+}
+
+func TestIndexedStoreBoundaries(t *testing.T) {
+	index := models.NewIndexedStore(models.NewMemoryStore())
+	now := time.Now()
+
+	index.CreateBanner("test", utils.AdminParams{Title: "ending", StartAt: now, EndAt: now.Add(50 * time.Millisecond)})
+	index.CreateBanner("test", utils.AdminParams{Title: "starting", StartAt: now.Add(50 * time.Millisecond), EndAt: now.Add(time.Hour)})
+
+	items, _ := index.SearchBanner(utils.PublicParams{})
+	assert.DeepEqual(t, []string{"ending"}, titles(items))
+
+	// the live set is rebuilt once a banner starts or ends, without a write or a reload
+	time.Sleep(60 * time.Millisecond)
+	items, _ = index.SearchBanner(utils.PublicParams{})
+	assert.DeepEqual(t, []string{"starting"}, titles(items))
+}
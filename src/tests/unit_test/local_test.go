@@ -0,0 +1,87 @@
+package unit_test
+
+import (
+	"context"
+	"main/cache"
+	"main/utils"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestLocalCache(t *testing.T) {
+	local := cache.NewLocalCache(2)
+	items := []utils.Item{{ID: 1, Title: "test"}}
+
+	// the least recently used key is dropped once the size is reached
+	local.Set("a", items, time.Minute)
+	local.Set("b", items, time.Minute)
+	if !local.Has("a") {
+		t.Errorf("Key a should be cached")
+	}
+	local.Set("c", items, time.Minute)
+
+	if local.Len() != 2 {
+		t.Errorf("Local cache should hold 2 keys, got %d", local.Len())
+	}
+	if local.Has("b") {
+		t.Errorf("Key b should have been evicted")
+	}
+	if !local.Has("a") || !local.Has("c") {
+		t.Errorf("Keys a and c should be cached")
+	}
+
+	// expired keys are not served
+	local.Set("d", items, -time.Second)
+	if local.Has("d") {
+		t.Errorf("Expired key d should not be served")
+	}
+
+	local.Delete("a")
+	if local.Has("a") {
+		t.Errorf("Deleted key a should not be cached")
+	}
+
+	local.Purge()
+	if local.Len() != 0 {
+		t.Errorf("Purged local cache should be empty")
+	}
+
+	// size 0 disables the local cache
+	disabled := cache.NewLocalCache(0)
+	disabled.Set("a", items, time.Minute)
+	if disabled.Has("a") {
+		t.Errorf("Disabled local cache should not hold keys")
+	}
+}
+
+// a published banner reaches the other watchers but not the one that wrote it
+func TestWatchBannerChanges(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache.RedisClient = redis.NewClient(&redis.Options{Addr: server.Addr()})
+
+	writes, others := make(chan uint, 1), make(chan uint, 1)
+	publish := cache.WatchBannerChanges(func(id uint) { writes <- id })
+	cache.WatchBannerChanges(func(id uint) { others <- id })
+
+	if err := publish(context.Background(), 7); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case id := <-others:
+		if id != 7 {
+			t.Errorf("Other watcher got banner %d, want 7", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Other watcher did not get the banner")
+	}
+
+	select {
+	case id := <-writes:
+		t.Errorf("Writer got its own banner %d back", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,166 @@
+package unit_test
+
+import (
+	"main/models"
+	"main/utils"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func titles(items []utils.Item) []string {
+	names := []string{}
+	for _, item := range items {
+		names = append(names, item.Title)
+	}
+	return names
+}
+
+func TestMemoryStoreSearch(t *testing.T) {
+	store := models.NewMemoryStore()
+	now := time.Now()
+
+	banners := []utils.AdminParams{
+		{Title: "TestAge", StartAt: now, EndAt: now.Add(1 * time.Hour), Conditions: utils.ConditionParams{AgeStart: 18, AgeEnd: 30, Gender: []string{"F"}, Country: []string{"TW", "JP"}, Platform: []string{"web"}}},
+		{Title: "TestGender", StartAt: now, EndAt: now.Add(2 * time.Hour), Conditions: utils.ConditionParams{AgeStart: 31, AgeEnd: 40, Gender: []string{"M"}, Country: []string{"TW", "JP"}, Platform: []string{"web"}}},
+		{Title: "TestCountry", StartAt: now, EndAt: now.Add(3 * time.Hour), Conditions: utils.ConditionParams{AgeStart: 31, AgeEnd: 40, Gender: []string{"F"}, Country: []string{"US", "UK"}, Platform: []string{"web"}}},
+		{Title: "TestPlatform", StartAt: now, EndAt: now.Add(4 * time.Hour), Conditions: utils.ConditionParams{AgeStart: 31, AgeEnd: 40, Gender: []string{"F"}, Country: []string{"TW", "JP"}, Platform: []string{"web", "android"}}},
+		{Title: "TestAll", StartAt: now, EndAt: now.Add(5 * time.Hour)},
+		{Title: "TestExcluded", StartAt: now, EndAt: now.Add(6 * time.Hour), Conditions: utils.ConditionParams{ExcludeCountry: []string{"TW"}}},
+		{Title: "TestUpcoming", StartAt: now.Add(time.Hour), EndAt: now.Add(2 * time.Hour)},
+		{Title: "TestDraft", Status: models.StatusDraft, StartAt: now, EndAt: now.Add(time.Hour)},
+		{Title: "TestPriority", Priority: 10, StartAt: now, EndAt: now.Add(7 * time.Hour), Conditions: utils.ConditionParams{Platform: []string{"ios"}}},
+	}
+	for _, b := range banners {
+		_, err := store.CreateBanner("test", b)
+		assert.NilError(t, err)
+	}
+
+	tests := []struct {
+		name   string
+		params utils.PublicParams
+		want   []string
+	}{
+		{"age", utils.PublicParams{Age: 20}, []string{"TestPriority", "TestAge", "TestAll", "TestExcluded"}},
+		{"gender", utils.PublicParams{Gender: "M", Rank: models.RankEndAt}, []string{"TestGender", "TestAll", "TestExcluded", "TestPriority"}},
+		{"country", utils.PublicParams{Country: "TW", Platform: "android"}, []string{"TestPlatform", "TestAll"}},
+		{"priority", utils.PublicParams{Platform: "ios"}, []string{"TestPriority", "TestAll", "TestExcluded"}},
+		{"end_at", utils.PublicParams{Platform: "ios", Rank: models.RankEndAt}, []string{"TestAll", "TestExcluded", "TestPriority"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := store.SearchBanner(tt.params)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, tt.want, titles(items))
+		})
+	}
+
+	// the filters see the ranked banners
+	items, err := store.SearchBanner(utils.PublicParams{Age: 20}, func(banners []models.Banner) ([]models.Banner, error) {
+		return banners[1:], nil
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"TestAge", "TestAll", "TestExcluded"}, titles(items))
+
+	// the upcoming banner is the next boundary of a query it matches
+	boundary, ok, err := store.NextBannerBoundary(utils.PublicParams{}, now)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	assert.Equal(t, now.Add(time.Hour), boundary)
+
+	crossed, err := store.CrossedBanners(now.Add(30*time.Minute), now.Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(crossed))
+	assert.Equal(t, "TestAge", crossed[0].Title)
+	assert.Equal(t, "TestUpcoming", crossed[1].Title)
+}
+
+func TestMemoryStoreSchedules(t *testing.T) {
+	store := models.NewMemoryStore()
+	now := time.Now().UTC()
+	minute := now.Hour()*60 + now.Minute()
+	day := []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}[now.Weekday()]
+
+	if minute == 0 {
+		t.Skip("a window ending at midnight runs all day")
+	}
+
+	// the closed window ends right at the current minute
+	open := utils.ScheduleParams{Days: []string{day}, Start: "00:00", End: "24:00"}
+	closed := utils.ScheduleParams{Days: []string{day}, Start: "00:00", End: now.Format("15:04")}
+
+	store.CreateBanner("test", utils.AdminParams{Title: "open", StartAt: now, EndAt: now.Add(time.Hour), Schedules: []utils.ScheduleParams{open}})
+	store.CreateBanner("test", utils.AdminParams{Title: "closed", StartAt: now, EndAt: now.Add(time.Hour), Schedules: []utils.ScheduleParams{closed}})
+
+	items, err := store.SearchBanner(utils.PublicParams{Timezone: "UTC"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"open"}, titles(items))
+
+	next, ok, err := store.NextScheduleChange(now)
+	assert.NilError(t, err)
+	assert.Assert(t, ok && next > 0 && next <= 24*time.Hour)
+}
+
+func TestMemoryStoreBanners(t *testing.T) {
+	store := models.NewMemoryStore()
+	now := time.Now()
+
+	id, err := store.CreateBanner("test", utils.AdminParams{Title: "first", Status: models.StatusDraft, StartAt: now, EndAt: now.Add(time.Hour)})
+	assert.NilError(t, err)
+	store.CreateBanner("test", utils.AdminParams{Title: "second", StartAt: now, EndAt: now.Add(time.Hour)})
+	store.CreateBanner("test", utils.AdminParams{Title: "third", StartAt: now, EndAt: now.Add(time.Hour)})
+
+	banner, err := store.GetBanner(id)
+	assert.NilError(t, err)
+	assert.Equal(t, "first", banner.Title)
+	assert.Equal(t, 1, banner.Weight)
+	assert.Equal(t, models.RotationEven, banner.CreativeRotation)
+
+	_, err = store.GetBanner(42)
+	assert.Equal(t, models.ErrBannerNotFound, err)
+
+	// listing pages through the banners by id
+	list, total, err := store.ListBanners(utils.ListParams{Limit: 1, Offset: 1})
+	assert.NilError(t, err)
+	assert.Equal(t, int64(3), total)
+	assert.Equal(t, "second", list[0].Title)
+
+	list, total, _ = store.ListBanners(utils.ListParams{Limit: 20, Status: models.StatusDraft})
+	assert.Equal(t, int64(1), total)
+	assert.Equal(t, "first", list[0].Title)
+
+	// an update keeps the status
+	err = store.UpdateBanner("test", id, utils.AdminParams{Title: "renamed", StartAt: now, EndAt: now.Add(time.Hour)})
+	assert.NilError(t, err)
+	banner, _ = store.GetBanner(id)
+	assert.Equal(t, "renamed", banner.Title)
+	assert.Equal(t, models.StatusDraft, banner.Status)
+
+	_, err = store.TransitionBanner("test", id, models.StatusStopped)
+	assert.Equal(t, models.ErrInvalidTransition, err)
+	before, err := store.TransitionBanner("test", id, models.StatusActive)
+	assert.NilError(t, err)
+	assert.Equal(t, models.StatusDraft, before.Status)
+
+	// creatives come back with the search results
+	creativeID, err := store.CreateCreative(id, utils.CreativeParams{ImageURL: "https://example.com/a.png", LinkURL: "https://example.com"})
+	assert.NilError(t, err)
+	assert.NilError(t, store.UpdateCreative(id, creativeID, utils.CreativeParams{ImageURL: "https://example.com/b.png", LinkURL: "https://example.com", Weight: 2}))
+	assert.Equal(t, models.ErrCreativeNotFound, store.UpdateCreative(id, 42, utils.CreativeParams{}))
+
+	items, _ := store.SearchBanner(utils.PublicParams{})
+	assert.Equal(t, "renamed", items[0].Title)
+	assert.Equal(t, "https://example.com/b.png", items[0].Creatives[0].ImageURL)
+	assert.Equal(t, models.RotationEven, items[0].Rotation)
+
+	assert.NilError(t, store.DeleteCreative(id, creativeID))
+	creatives, _ := store.ListCreatives(id)
+	assert.Equal(t, 0, len(creatives))
+
+	assert.NilError(t, store.DeleteBanner("test", id))
+	assert.Equal(t, models.ErrBannerNotFound, store.DeleteBanner("test", id))
+	_, err = store.CreateCreative(id, utils.CreativeParams{})
+	assert.Equal(t, models.ErrBannerNotFound, err)
+}
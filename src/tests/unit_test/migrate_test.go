@@ -0,0 +1,125 @@
+package unit_test
+
+import (
+	"main/models"
+	"main/utils"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gotest.tools/assert"
+)
+
+func openMigrateDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:?_pragma=foreign_keys(1)"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	assert.NilError(t, err)
+	sqlDb, _ := db.DB()
+	sqlDb.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDb.Close() })
+	return db
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	db := openMigrateDB(t)
+
+	migrations, err := models.Migrations(db)
+	assert.NilError(t, err)
+	assert.Assert(t, len(migrations) >= 2)
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version)
+	}
+
+	applied, err := models.MigrateUp(db)
+	assert.NilError(t, err)
+	assert.Equal(t, len(migrations), len(applied))
+	assert.Assert(t, db.Migrator().HasIndex("banners", "idx_banners_start_at_end_at"))
+
+	// nothing is pending the second time
+	applied, err = models.MigrateUp(db)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(applied))
+
+	// everything but the first, newest first
+	reverted, err := models.MigrateDown(db, len(migrations)-1)
+	assert.NilError(t, err)
+	assert.Equal(t, len(migrations)-1, len(reverted))
+	assert.Equal(t, migrations[len(migrations)-1].Version, reverted[0].Version)
+	assert.Assert(t, !db.Migrator().HasIndex("banners", "idx_banners_start_at_end_at"))
+
+	states, err := models.MigrationStatus(db)
+	assert.NilError(t, err)
+	assert.Assert(t, states[0].AppliedAt != nil)
+	assert.Assert(t, states[1].AppliedAt == nil)
+
+	reverted, err = models.MigrateDown(db, len(migrations))
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(reverted))
+	assert.Assert(t, !db.Migrator().HasTable("banners"))
+}
+
+func TestMigratedSchemaServesStore(t *testing.T) {
+	db := openMigrateDB(t)
+	_, err := models.MigrateUp(db)
+	assert.NilError(t, err)
+
+	store := models.NewGormStore(db)
+	now := time.Now()
+	id, err := store.CreateBanner("test", utils.AdminParams{Title: "tw", StartAt: now.Add(-time.Minute), EndAt: now.Add(time.Hour), Conditions: utils.ConditionParams{Country: []string{"TW"}, Platform: []string{"ios"}}})
+	assert.NilError(t, err)
+
+	items, err := store.SearchBanner(utils.PublicParams{Country: "TW", Platform: "ios"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"tw"}, titles(items))
+
+	// the conditions go with the banner through the foreign keys
+	assert.NilError(t, store.DeleteBanner("test", id))
+	var count int64
+	db.Table("banner_country").Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+// the banners table as the baseline AutoMigrate created it, before any of the later columns
+type baselineBanner struct {
+	ID        uint
+	Title     string
+	StartAt   time.Time
+	EndAt     time.Time
+	AgeStart  int
+	AgeEnd    int
+	Genders   []models.Gender   `gorm:"many2many:banner_gender;joinForeignKey:BannerID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Countries []models.Country  `gorm:"many2many:banner_country;joinForeignKey:BannerID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Platforms []models.Platform `gorm:"many2many:banner_platform;joinForeignKey:BannerID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+func (baselineBanner) TableName() string {
+	return "banners"
+}
+
+func TestMigrateUpAdoptsBaseline(t *testing.T) {
+	db := openMigrateDB(t)
+	assert.NilError(t, db.AutoMigrate(&baselineBanner{}, &models.Gender{}, &models.Country{}, &models.Platform{}))
+
+	now := time.Now()
+	old := baselineBanner{Title: "old", StartAt: now.Add(-time.Minute), EndAt: now.Add(time.Hour), Countries: []models.Country{{Name: "TW"}}}
+	assert.NilError(t, db.Create(&old).Error)
+
+	_, err := models.MigrateUp(db)
+	assert.NilError(t, err)
+
+	// the existing banner keeps serving with the defaults of the new columns
+	store := models.NewGormStore(db)
+	banner, err := store.GetBanner(old.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, models.StatusActive, banner.Status)
+	assert.Equal(t, 1, banner.Weight)
+	assert.Equal(t, "even", banner.CreativeRotation)
+
+	items, err := store.SearchBanner(utils.PublicParams{Country: "TW"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"old"}, titles(items))
+
+	_, err = store.CreateBanner("test", utils.AdminParams{Title: "new", StartAt: now, EndAt: now.Add(time.Hour), Priority: 2})
+	assert.NilError(t, err)
+}
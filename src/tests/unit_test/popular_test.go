@@ -0,0 +1,64 @@
+package unit_test
+
+import (
+	"context"
+	"fmt"
+	"main/cache"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
+	"gotest.tools/assert"
+)
+
+func TestRecordQuery(t *testing.T) {
+	rc, mock := redismock.NewClientMock()
+	cache.RedisClient = rc
+
+	key := "/api/v1/ad?country=TW&rank=priority"
+	day := "popular:" + time.Now().Format("20060102")
+
+	mock.ExpectZIncrBy(day, 1, key).SetVal(1)
+	mock.ExpectExpire(day, 48*time.Hour).SetVal(true)
+
+	err := cache.RecordQuery(context.Background(), key)
+	assert.NilError(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPopularQueries(t *testing.T) {
+	rc, mock := redismock.NewClientMock()
+	cache.RedisClient = rc
+
+	now := time.Now()
+	today := "popular:" + now.Format("20060102")
+	yesterday := "popular:" + now.AddDate(0, 0, -1).Format("20060102")
+
+	// the counts of both days add up
+	mock.ExpectZRevRangeWithScores(today, 0, 1).SetVal([]redis.Z{
+		{Member: "/api/v1/ad?country=TW&rank=priority", Score: 3},
+		{Member: "/api/v1/ad?gender=F&rank=priority", Score: 2},
+	})
+	mock.ExpectZRevRangeWithScores(yesterday, 0, 1).SetVal([]redis.Z{
+		{Member: "/api/v1/ad?gender=F&rank=priority", Score: 5},
+		{Member: "/api/v1/ad?platform=ios&rank=priority", Score: 1},
+	})
+
+	keys, err := cache.PopularQueries(context.Background(), 2)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"/api/v1/ad?gender=F&rank=priority", "/api/v1/ad?country=TW&rank=priority"}, keys)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+
+	// Error case
+	mock.ExpectZRevRangeWithScores(today, 0, 1).SetErr(fmt.Errorf("error fetching popular queries"))
+
+	_, err = cache.PopularQueries(context.Background(), 2)
+	assert.Error(t, err, "error fetching popular queries")
+}
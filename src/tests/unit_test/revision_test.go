@@ -0,0 +1,117 @@
+package unit_test
+
+import (
+	"main/models"
+	"main/utils"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func testBannerHistory(t *testing.T, store models.BannerStore) {
+	now := time.Now().Truncate(time.Second)
+	original := utils.AdminParams{Title: "tw", StartAt: now, EndAt: now.Add(time.Hour), Conditions: utils.ConditionParams{Country: []string{"TW"}}}
+
+	id, err := store.CreateBanner("alice", original)
+	assert.NilError(t, err)
+
+	changed := original
+	changed.Title = "us"
+	changed.Conditions = utils.ConditionParams{Country: []string{"US"}, Platform: []string{"ios"}}
+	assert.NilError(t, store.UpdateBanner("bob", id, changed))
+
+	_, err = store.TransitionBanner("bob", id, models.StatusPaused)
+	assert.NilError(t, err)
+
+	history, err := store.BannerHistory(id)
+	assert.NilError(t, err)
+	assert.Equal(t, 3, len(history))
+
+	created := history[0].Detail()
+	assert.Equal(t, models.RevisionCreate, created.Action)
+	assert.Equal(t, "alice", created.Actor)
+	assert.Assert(t, created.Before == nil)
+	assert.Equal(t, "tw", created.After.Title)
+
+	updated := history[1].Detail()
+	assert.Equal(t, models.RevisionUpdate, updated.Action)
+	assert.Equal(t, "bob", updated.Actor)
+	assert.DeepEqual(t, utils.FieldChange{Before: "tw", After: "us"}, updated.Changes["title"])
+	assert.DeepEqual(t, []interface{}{"US"}, updated.Changes["conditions.country"].After)
+	_, ok := updated.Changes["startAt"]
+	assert.Assert(t, !ok)
+
+	status := history[2].Detail()
+	assert.Equal(t, models.RevisionStatus, status.Action)
+	assert.DeepEqual(t, utils.FieldChange{Before: models.StatusActive, After: models.StatusPaused}, status.Changes["status"])
+
+	// a restore goes back to the fields and conditions, the status stays
+	restored, err := store.RestoreBanner("carol", id, history[0].ID)
+	assert.NilError(t, err)
+	assert.Equal(t, models.RevisionRestore, restored.Action)
+	assert.Equal(t, history[0].ID, restored.RestoredFrom)
+
+	banner, err := store.GetBanner(id)
+	assert.NilError(t, err)
+	assert.Equal(t, "tw", banner.Title)
+	assert.DeepEqual(t, []string{"TW"}, banner.Conditions().Country)
+	assert.Equal(t, models.StatusPaused, banner.Status)
+
+	_, err = store.RestoreBanner("carol", id+1, history[0].ID)
+	assert.Equal(t, models.ErrRevisionNotFound, err)
+
+	// the history outlives the banner, which can no longer be restored
+	assert.NilError(t, store.DeleteBanner("dave", id))
+	history, err = store.BannerHistory(id)
+	assert.NilError(t, err)
+	assert.Equal(t, 5, len(history))
+	deleted := history[4].Detail()
+	assert.Equal(t, models.RevisionDelete, deleted.Action)
+	assert.Assert(t, deleted.After == nil)
+
+	_, err = store.RestoreBanner("carol", id, history[4].ID)
+	assert.Equal(t, models.ErrNothingToRestore, err)
+	_, err = store.RestoreBanner("carol", id, history[0].ID)
+	assert.Equal(t, models.ErrBannerNotFound, err)
+}
+
+// promoting a variant renames the banner, which is recorded like an update
+func testPromotionHistory(t *testing.T, store models.BannerStore) {
+	now := time.Now().Truncate(time.Second)
+	id, err := store.CreateBanner("alice", utils.AdminParams{Title: "original", StartAt: now, EndAt: now.Add(time.Hour)})
+	assert.NilError(t, err)
+
+	experimentID, err := store.CreateExperiment(utils.ExperimentParams{BannerID: id, Variants: []utils.VariantParams{{Name: "a", Weight: 1}, {Name: "b", Title: "winner", Weight: 1}}})
+	assert.NilError(t, err)
+	experiment, err := store.GetExperiment(experimentID)
+	assert.NilError(t, err)
+	_, err = store.PromoteVariant("bob", experimentID, experiment.Variants[1].ID, nil, nil)
+	assert.NilError(t, err)
+
+	history, err := store.BannerHistory(id)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(history))
+	promoted := history[1].Detail()
+	assert.Equal(t, models.RevisionUpdate, promoted.Action)
+	assert.Equal(t, "bob", promoted.Actor)
+	assert.DeepEqual(t, map[string]utils.FieldChange{"title": {Before: "original", After: "winner"}}, promoted.Changes)
+}
+
+func TestMemoryStoreHistory(t *testing.T) {
+	testBannerHistory(t, models.NewMemoryStore())
+	testPromotionHistory(t, models.NewMemoryStore())
+}
+
+func TestGormStoreHistory(t *testing.T) {
+	db := openMigrateDB(t)
+	_, err := models.MigrateUp(db)
+	assert.NilError(t, err)
+
+	testBannerHistory(t, models.NewGormStore(db))
+	testPromotionHistory(t, models.NewGormStore(db))
+
+	// the revisions cannot be changed afterwards
+	assert.Assert(t, db.Exec("UPDATE banner_revisions SET actor = ?", "mallory").Error != nil)
+	assert.Assert(t, db.Exec("DELETE FROM banner_revisions").Error != nil)
+}
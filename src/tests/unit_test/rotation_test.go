@@ -0,0 +1,39 @@
+package unit_test
+
+import (
+	"main/utils"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestChooseCreatives(t *testing.T) {
+	items := []utils.Item{
+		{ID: 1001, Title: "Even", Creatives: []utils.CreativeItem{{ID: 1}, {ID: 2}, {ID: 3}}},
+		{ID: 1002, Title: "Weighted", Rotation: "weighted", Creatives: []utils.CreativeItem{{ID: 4, Weight: 1}, {ID: 5, Weight: 1000000}}},
+		{ID: 1003, Title: "NoCreative"},
+	}
+
+	// Even rotation takes turns
+	for _, want := range []uint{1, 2, 3, 1} {
+		chosen := utils.ChooseCreatives(items)
+		assert.Equal(t, want, chosen[0].Creative.ID)
+	}
+
+	chosen := utils.ChooseCreatives(items)
+
+	// Weighted rotation favours the heavy creative
+	assert.Equal(t, uint(5), chosen[1].Creative.ID)
+	assert.Equal(t, 0, chosen[1].Creative.Weight)
+
+	// Items without creatives are left alone
+	assert.Assert(t, chosen[2].Creative == nil)
+
+	// Candidates never leak into the response and the input is not touched
+	for i := range chosen {
+		assert.Equal(t, 0, len(chosen[i].Creatives))
+		assert.Equal(t, "", chosen[i].Rotation)
+	}
+	assert.Equal(t, 3, len(items[0].Creatives))
+	assert.Assert(t, items[0].Creative == nil)
+}
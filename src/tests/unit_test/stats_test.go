@@ -0,0 +1,109 @@
+package unit_test
+
+import (
+	"context"
+	"fmt"
+	"main/cache"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"gotest.tools/assert"
+)
+
+func TestRecordEvent(t *testing.T) {
+	rc, mock := redismock.NewClientMock()
+	cache.RedisClient = rc
+
+	field := "7:" + time.Now().Format("2006-01-02") + ":click"
+	mock.ExpectHIncrBy("{stats}:pending", field, 1).SetVal(1)
+
+	err := cache.RecordEvent(context.Background(), 7, cache.EventClick)
+
+	assert.NilError(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPopStats(t *testing.T) {
+	rc, mock := redismock.NewClientMock()
+	cache.RedisClient = rc
+
+	// Normal case
+	mock.ExpectExists("{stats}:flushing").SetVal(0)
+	mock.ExpectRename("{stats}:pending", "{stats}:flushing").SetVal("OK")
+	mock.ExpectHGetAll("{stats}:flushing").SetVal(map[string]string{
+		"7:2024-03-01:impression": "10",
+		"broken":                  "1",
+	})
+
+	stats, err := cache.PopStats(context.Background())
+
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(stats))
+	assert.Equal(t, uint(7), stats[0].BannerID)
+	assert.Equal(t, "2024-03-01", stats[0].Day.Format("2006-01-02"))
+	assert.Equal(t, cache.EventImpression, stats[0].Event)
+	assert.Equal(t, int64(10), stats[0].Count)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+
+	// A batch left over by a failed flush is retried before taking new events
+	mock.ExpectExists("{stats}:flushing").SetVal(1)
+	mock.ExpectHGetAll("{stats}:flushing").SetVal(map[string]string{})
+
+	_, err = cache.PopStats(context.Background())
+
+	assert.NilError(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+
+	// Nothing recorded
+	mock.ExpectExists("{stats}:flushing").SetVal(0)
+	mock.ExpectRename("{stats}:pending", "{stats}:flushing").SetErr(fmt.Errorf("ERR no such key"))
+
+	stats, err = cache.PopStats(context.Background())
+
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(stats))
+
+	// Error case
+	mock.ExpectExists("{stats}:flushing").SetErr(fmt.Errorf("error checking batch"))
+
+	_, err = cache.PopStats(context.Background())
+
+	if err == nil || err.Error() != "error checking batch" {
+		t.Errorf("Error was expected while popping stats")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLockStats(t *testing.T) {
+	rc, mock := redismock.NewClientMock()
+	cache.RedisClient = rc
+
+	mock.Regexp().ExpectSetNX(`\{stats\}:lock`, `^[0-9a-f]{32}$`, 5*time.Minute).SetVal(true)
+	token, ok, err := cache.LockStats(context.Background())
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+
+	// another replica holds the lock
+	mock.Regexp().ExpectSetNX(`\{stats\}:lock`, `^[0-9a-f]{32}$`, 5*time.Minute).SetVal(false)
+	other, ok, err := cache.LockStats(context.Background())
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+	assert.Assert(t, token != other)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -1,12 +1,32 @@
 package utils
 
-import "time"
+import (
+	"net/url"
+	"strconv"
+	"time"
+)
 
 type AdminParams struct {
-	Title      string          `form:"title" json:"title"`
-	StartAt    time.Time       `form:"startAt" json:"startAt"`
-	EndAt      time.Time       `form:"endAt" json:"endAt"`
-	Conditions ConditionParams `form:"conditions" json:"conditions"`
+	Title  string `form:"title" json:"title"`
+	Status string `form:"status" json:"status,omitempty"`
+	// how the creative is picked on every serve: even | weighted
+	CreativeRotation string             `form:"creativeRotation" json:"creativeRotation"`
+	Priority         int                `form:"priority" json:"priority"`
+	Weight           int                `form:"weight" json:"weight"`
+	FrequencyCap     FrequencyCapParams `form:"frequencyCap" json:"frequencyCap"`
+	Budget           BudgetParams       `form:"budget" json:"budget"`
+	StartAt          time.Time          `form:"startAt" json:"startAt"`
+	EndAt            time.Time          `form:"endAt" json:"endAt"`
+	Conditions       ConditionParams    `form:"conditions" json:"conditions"`
+	Schedules        []ScheduleParams   `form:"schedules" json:"schedules"`
+}
+
+// a recurring window, e.g. {"days": ["mon", "fri"], "start": "18:00", "end": "23:00"} in the viewer's time zone.
+// an end before the start runs past midnight
+type ScheduleParams struct {
+	Days  []string `form:"days" json:"days"`
+	Start string   `form:"start" json:"start"`
+	End   string   `form:"end" json:"end"`
 }
 
 type ConditionParams struct {
@@ -15,6 +35,54 @@ type ConditionParams struct {
 	Gender   []string `form:"gender" json:"gender"`
 	Country  []string `form:"country" json:"country"`
 	Platform []string `form:"platform" json:"platform"`
+
+	ExcludeGender   []string `form:"excludeGender" json:"excludeGender"`
+	ExcludeCountry  []string `form:"excludeCountry" json:"excludeCountry"`
+	ExcludePlatform []string `form:"excludePlatform" json:"excludePlatform"`
+}
+
+// whether a banner with these conditions can appear in the results of the given query,
+// mirroring the targeting part of the search. an empty query field matches everything
+func (cond ConditionParams) Matches(p PublicParams) bool {
+	if p.Age != 0 && (cond.AgeStart != 0 || cond.AgeEnd != 0) && (p.Age < cond.AgeStart || p.Age > cond.AgeEnd) {
+		return false
+	}
+	return matchesValue(p.Gender, cond.Gender, cond.ExcludeGender) &&
+		matchesValue(p.Country, cond.Country, cond.ExcludeCountry) &&
+		matchesValue(p.Platform, cond.Platform, cond.ExcludePlatform)
+}
+
+func matchesValue(value string, targeted, excluded []string) bool {
+	if value == "" {
+		return true
+	}
+	for _, v := range excluded {
+		if v == value {
+			return false
+		}
+	}
+	if len(targeted) == 0 {
+		return true
+	}
+	for _, v := range targeted {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// max impressions of a banner per user in each window, 0 means no cap
+type FrequencyCapParams struct {
+	Hour     int `form:"hour" json:"hour"`
+	Day      int `form:"day" json:"day"`
+	Lifetime int `form:"lifetime" json:"lifetime"`
+}
+
+// impression budgets, spread evenly over the banner's window, 0 means unlimited
+type BudgetParams struct {
+	Daily    int64 `form:"daily" json:"daily"`
+	Lifetime int64 `form:"lifetime" json:"lifetime"`
 }
 
 type PublicParams struct {
@@ -24,13 +92,198 @@ type PublicParams struct {
 	Gender   string `form:"gender"`
 	Country  string `form:"country"`
 	Platform string `form:"platform"`
+	Rank     string `form:"rank"`
+	UserID   string `form:"userId"`
+	// IANA time zone of the viewer, schedules are evaluated in it
+	Timezone string `form:"tz"`
+}
+
+// the viewer's time zone, the server's one when not given or unknown
+func (p PublicParams) Location() *time.Location {
+	if p.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// the same key for every query with the same result list, whatever the parameter order.
+// pagination is left out since every page is served from the same list.
+// expects the defaults applied, unknown and empty parameters are left out
+func (p PublicParams) CacheKey(path string) string {
+	query := url.Values{}
+	if p.Age != 0 {
+		query.Set("age", strconv.Itoa(p.Age))
+	}
+	if p.Gender != "" {
+		query.Set("gender", p.Gender)
+	}
+	if p.Country != "" {
+		query.Set("country", p.Country)
+	}
+	if p.Platform != "" {
+		query.Set("platform", p.Platform)
+	}
+	if p.Timezone != "" {
+		query.Set("tz", p.Timezone)
+	}
+	query.Set("rank", p.Rank)
+	return path + "?" + query.Encode()
+}
+
+// the requested page of an ordered result list, nil when it is empty
+func (p PublicParams) Page(items []Item) []Item {
+	offset := p.Offset
+	if offset < 0 {
+		offset = 0
+	}
+	end := offset + p.Limit
+	if end > len(items) {
+		end = len(items)
+	}
+	if offset >= end {
+		return nil
+	}
+	return items[offset:end]
 }
 
 type Item struct {
-	Title string    `json:"title"`
-	EndAt time.Time `json:"endAt"`
+	ID       uint          `json:"id"`
+	Title    string        `json:"title"`
+	EndAt    time.Time     `json:"endAt"`
+	Creative *CreativeItem `json:"creative,omitempty"`
+	// experiment variant the user was bucketed into, to be sent back with clicks
+	VariantID uint `json:"variantId,omitempty"`
+	// candidates the creative is picked from on every serve, cached but never sent to clients
+	Creatives []CreativeItem `json:"creatives,omitempty"`
+	Rotation  string         `json:"rotation,omitempty"`
+}
+
+type CreativeItem struct {
+	ID       uint   `json:"id"`
+	ImageURL string `json:"imageUrl"`
+	LinkURL  string `json:"linkUrl"`
+	CTAText  string `json:"ctaText,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	AltText  string `json:"altText,omitempty"`
+	Weight   int    `json:"weight,omitempty"`
 }
 
 type CachedItem struct {
 	Data []Item `json:"data"`
 }
+
+type ListParams struct {
+	Limit  int    `form:"limit"`
+	Offset int    `form:"offset"`
+	Status string `form:"status"`
+}
+
+type StatusParams struct {
+	Status string `form:"status" json:"status"`
+}
+
+type BannerDetail struct {
+	ID uint `json:"id"`
+	AdminParams
+	Creatives []CreativeDetail `json:"creatives"`
+}
+
+type CreativeParams struct {
+	ImageURL string `form:"imageUrl" json:"imageUrl"`
+	LinkURL  string `form:"linkUrl" json:"linkUrl"`
+	CTAText  string `form:"ctaText" json:"ctaText"`
+	Width    int    `form:"width" json:"width"`
+	Height   int    `form:"height" json:"height"`
+	AltText  string `form:"altText" json:"altText"`
+	Weight   int    `form:"weight" json:"weight"`
+}
+
+type CreativeDetail struct {
+	ID uint `json:"id"`
+	CreativeParams
+}
+
+type BannerList struct {
+	Data  []BannerDetail `json:"data"`
+	Total int64          `json:"total"`
+}
+
+// one change of a banner, before is null when it was created and after when it was deleted
+type RevisionDetail struct {
+	ID           uint                   `json:"id"`
+	BannerID     uint                   `json:"bannerId"`
+	Action       string                 `json:"action"`
+	Actor        string                 `json:"actor"`
+	CreatedAt    time.Time              `json:"createdAt"`
+	RestoredFrom uint                   `json:"restoredFrom,omitempty"`
+	Before       *AdminParams           `json:"before"`
+	After        *AdminParams           `json:"after"`
+	Changes      map[string]FieldChange `json:"changes"`
+}
+
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type RevisionList struct {
+	Data []RevisionDetail `json:"data"`
+}
+
+type ReportParams struct {
+	BannerID uint      `form:"bannerId"`
+	From     time.Time `form:"from" time_format:"2006-01-02"`
+	To       time.Time `form:"to" time_format:"2006-01-02"`
+}
+
+type ReportItem struct {
+	BannerID    uint    `json:"bannerId"`
+	Day         string  `json:"day"`
+	Impressions int64   `json:"impressions"`
+	Clicks      int64   `json:"clicks"`
+	CTR         float64 `json:"ctr"`
+}
+
+type ExperimentParams struct {
+	BannerID uint            `form:"bannerId" json:"bannerId"`
+	Variants []VariantParams `form:"variants" json:"variants"`
+}
+
+// empty title or zero creativeId keep the banner's own, weight is the share of users
+type VariantParams struct {
+	Name       string `form:"name" json:"name"`
+	Title      string `form:"title" json:"title"`
+	CreativeID uint   `form:"creativeId" json:"creativeId"`
+	Weight     int    `form:"weight" json:"weight"`
+}
+
+type VariantDetail struct {
+	ID uint `json:"id"`
+	VariantParams
+	Exposures int64   `json:"exposures"`
+	Clicks    int64   `json:"clicks"`
+	CTR       float64 `json:"ctr"`
+}
+
+type ExperimentDetail struct {
+	ID              uint            `json:"id"`
+	BannerID        uint            `json:"bannerId"`
+	Status          string          `json:"status"`
+	WinnerVariantID uint            `json:"winnerVariantId,omitempty"`
+	Variants        []VariantDetail `json:"variants"`
+}
+
+type PromoteParams struct {
+	VariantID uint `form:"variantId" json:"variantId"`
+}
+
+// everything when empty, every query filtering by the dimension, or only the ones filtering by its value
+type InvalidateParams struct {
+	Dimension string `form:"dimension" json:"dimension"`
+	Value     string `form:"value" json:"value"`
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// key: banner id, value: *uint64 counting the serves of the banner in this process
+var rotationCounters sync.Map
+
+// picks the creative to show for every item out of its candidates, evenly in turn or by weight.
+// the items are copied since cached and single flight results are shared between requests
+func ChooseCreatives(items []Item) []Item {
+	if items == nil {
+		return nil
+	}
+
+	chosen := make([]Item, len(items))
+	for i, item := range items {
+		chosen[i] = item
+		chosen[i].Creatives = nil
+		chosen[i].Rotation = ""
+
+		if len(item.Creatives) == 0 {
+			continue
+		}
+
+		var creative CreativeItem
+		if item.Rotation == "weighted" {
+			creative = weightedCreative(item.Creatives)
+		} else {
+			counter, _ := rotationCounters.LoadOrStore(item.ID, new(uint64))
+			n := atomic.AddUint64(counter.(*uint64), 1)
+			creative = item.Creatives[(n-1)%uint64(len(item.Creatives))]
+		}
+		creative.Weight = 0
+		chosen[i].Creative = &creative
+	}
+	return chosen
+}
+
+func weightedCreative(creatives []CreativeItem) CreativeItem {
+	total := 0
+	for _, c := range creatives {
+		total += creativeWeight(c)
+	}
+
+	n := rand.Intn(total)
+	for _, c := range creatives {
+		if n -= creativeWeight(c); n < 0 {
+			return c
+		}
+	}
+	return creatives[len(creatives)-1]
+}
+
+func creativeWeight(c CreativeItem) int {
+	if c.Weight <= 0 {
+		return 1
+	}
+	return c.Weight
+}